@@ -0,0 +1,226 @@
+package main
+
+/*
+Package tjob - Artifact Commands
+
+Copyright (c) 2014 Ohmu Ltd.
+Licensed under the Apache License, Version 2.0 (see LICENSE)
+*/
+
+import (
+	"fmt"
+	"github.com/ohmu/tjob/config"
+	"github.com/ohmu/tjob/jenkins"
+	"github.com/ohmu/tjob/pipeline"
+	"github.com/ohmu/tjob/tabout"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+func init() {
+	globalParser().AddCommand("artifacts", "Artifact commands", "Artifact commands", &struct { // TODO: long desc
+		List artifactsListCmd `command:"ls" description:"List build artifacts"`
+		Get  artifactsGetCmd  `command:"get" description:"Download build artifacts"`
+	}{})
+}
+
+type artifactFlags struct {
+	filterFlags
+	Globs []string `short:"g" long:"glob" description:"Select only artifacts whose relative path matches a glob, '*' does not match '/'"`
+}
+
+type artifactsListCmd struct {
+	artifactFlags
+}
+
+type artifactsGetCmd struct {
+	artifactFlags
+	Dir string `long:"dir" default:"." description:"Download directory, artifacts are stored under runner/job/build/"`
+}
+
+type buildArtifact struct {
+	*JobStatus
+	jenkins.Artifact
+	size   int64
+	result string
+	err    error
+}
+
+// artifactLister sends the matching artifacts of each build
+type artifactLister struct {
+	pipeline.Node
+	conf     *config.Config
+	globs    []string
+	withSize bool
+	Input    chan *JobStatus
+	Output   chan *buildArtifact
+}
+
+func (node *artifactLister) send(artifact *buildArtifact) bool {
+	select {
+	case <-node.AbortChannel():
+		return false
+	case node.Output <- artifact:
+		return true
+	}
+}
+
+func (node *artifactLister) Run() error {
+	defer close(node.Output)
+	for res := range node.Input {
+		if res.err != nil || res.IsQueued() {
+			continue
+		}
+		jenk, err := getJenkins(node.conf, res.Runner)
+		if err != nil {
+			return node.AbortWithError(err)
+		}
+		artifacts, err := jenk.QueryArtifacts(node.Context(), res.JobName,
+			res.BuildNumber)
+		if err != nil {
+			if !node.send(&buildArtifact{JobStatus: res, err: err}) {
+				return nil
+			}
+			continue
+		}
+		for _, artifact := range artifacts {
+			matched, err := listFilter(node.globs, artifact.RelativePath)
+			if err != nil {
+				return node.AbortWithError(err)
+			} else if !matched {
+				continue
+			}
+			out := &buildArtifact{JobStatus: res, Artifact: artifact}
+			if node.withSize {
+				out.size, out.err = jenk.ArtifactSize(
+					node.Context(), res.JobName,
+					res.BuildNumber, artifact.RelativePath)
+			}
+			if !node.send(out) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// artifactDownloader downloads artifacts concurrently, the request limiter
+// of the Jenkins client keeps the number of parallel transfers in check
+type artifactDownloader struct {
+	pipeline.Node
+	conf   *config.Config
+	dir    string
+	Input  chan *buildArtifact
+	Output chan *buildArtifact
+}
+
+func (node *artifactDownloader) Run() error {
+	defer close(node.Output)
+	wg := sync.WaitGroup{}
+	for artifact := range node.Input {
+		if artifact.err != nil {
+			select {
+			case <-node.AbortChannel():
+				return nil
+			case node.Output <- artifact:
+			}
+			continue
+		}
+		jenk, err := getJenkins(node.conf, artifact.Runner)
+		if err != nil {
+			return node.AbortWithError(err)
+		}
+		wg.Add(1)
+		go func(artifact *buildArtifact) {
+			defer wg.Done()
+			dest := filepath.Join(node.dir, artifact.Runner,
+				filepath.FromSlash(artifact.JobName),
+				artifact.BuildNumber,
+				filepath.FromSlash(path.Clean("/"+
+					artifact.RelativePath)))
+			artifact.result, artifact.err = jenk.DownloadArtifact(
+				node.Context(), artifact.JobName, artifact.BuildNumber,
+				artifact.RelativePath, dest)
+			select {
+			case <-node.AbortChannel():
+			case node.Output <- artifact:
+			}
+		}(artifact)
+	}
+	wg.Wait()
+	return nil
+}
+
+type artifactRenderer struct {
+	pipeline.Node
+	fields []string
+	failed int
+	Input  chan *buildArtifact
+}
+
+func (node *artifactRenderer) Run() error {
+	output := tabout.New(node.fields, nil)
+	for artifact := range node.Input {
+		var errStr, size string
+		if artifact.err != nil {
+			errStr = artifact.err.Error()
+			node.failed++
+		} else {
+			size = strconv.FormatInt(artifact.size, 10)
+		}
+		if err := output.Write(map[string]string{
+			"RUNNER": artifact.Runner, "JOB": artifact.JobName,
+			"BUILD": artifact.BuildNumber,
+			"PATH":  artifact.RelativePath, "SIZE": size,
+			"RESULT": artifact.result, "ERROR": errStr,
+		}); err != nil {
+			return node.AbortWithError(err)
+		}
+	}
+	output.Flush()
+	return nil
+}
+
+func (r *artifactsListCmd) Execute(args []string) error {
+	conf, err := config.Load(globalFlags.ConfigFile)
+	if err != nil {
+		return err
+	}
+	nodes, selected, _ := selectedBuilds(conf, &r.filterFlags)
+	listed := artifactLister{Input: selected,
+		Output: make(chan *buildArtifact, 10), conf: conf,
+		globs: r.Globs, withSize: true}
+	rendered := artifactRenderer{Input: listed.Output,
+		fields: []string{"RUNNER", "JOB", "BUILD", "SIZE", "PATH",
+			"ERROR"}}
+	errors := pipeline.Wait(globalContext,
+		append(nodes, &listed, &rendered)...)
+	return handleErrors(errors)
+}
+
+func (r *artifactsGetCmd) Execute(args []string) error {
+	conf, err := config.Load(globalFlags.ConfigFile)
+	if err != nil {
+		return err
+	}
+	nodes, selected, _ := selectedBuilds(conf, &r.filterFlags)
+	listed := artifactLister{Input: selected,
+		Output: make(chan *buildArtifact, 10), conf: conf,
+		globs: r.Globs}
+	downloaded := artifactDownloader{Input: listed.Output,
+		Output: make(chan *buildArtifact, 10), conf: conf, dir: r.Dir}
+	rendered := artifactRenderer{Input: downloaded.Output,
+		fields: []string{"RUNNER", "JOB", "BUILD", "PATH", "RESULT",
+			"ERROR"}}
+	errors := pipeline.Wait(globalContext,
+		append(nodes, &listed, &downloaded, &rendered)...)
+	if err := handleErrors(errors); err != nil {
+		return err
+	}
+	if rendered.failed > 0 {
+		return fmt.Errorf("%d artifacts failed", rendered.failed)
+	}
+	return nil
+}
@@ -0,0 +1,424 @@
+package main
+
+/*
+Package tjob - Cache Commands
+
+Copyright (c) 2014 Ohmu Ltd.
+Licensed under the Apache License, Version 2.0 (see LICENSE)
+*/
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ohmu/tjob/config"
+	"github.com/ohmu/tjob/jenkins"
+	"github.com/ohmu/tjob/tabout"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	globalParser().AddCommand("cache", "Build cache commands", "Build cache commands", &struct {
+		Stats      cacheStatsCmd      `command:"stats" description:"Show the number and size of cached builds"`
+		GC         cacheGCCmd         `command:"gc" description:"Evict cached builds"`
+		Invalidate cacheInvalidateCmd `command:"invalidate" description:"Make the selected builds be fetched again from Jenkins"`
+		Export     cacheExportCmd     `command:"export" description:"Write the selected builds to a compressed bundle"`
+		Import     cacheImportCmd     `command:"import" description:"Merge a bundle into the cache, keeping the builds fetched later"`
+	}{})
+}
+
+type cacheFilterFlags struct {
+	FilterRunner []string `short:"r" long:"runner" description:"Select only builds for the given runner"`
+	FilterJob    []string `short:"j" long:"job" description:"Select only builds for the given job, or folder path like team/project/master"`
+	FilterBuild  []string `short:"b" long:"build" description:"Select only builds with buildnumber"`
+}
+
+var (
+	cachesMutex sync.Mutex
+	caches      = make(map[string]*jenkins.JobCache)
+)
+
+// configCache returns the build cache of the config, shared by all its
+// runners so that the store is opened only once
+func configCache(conf *config.Config) *jenkins.JobCache {
+	dir := path.Join(conf.Dir(), "cache")
+	cachesMutex.Lock()
+	defer cachesMutex.Unlock()
+	if caches[dir] == nil {
+		caches[dir] = &jenkins.JobCache{CacheDir: dir}
+	}
+	return caches[dir]
+}
+
+// cacheEntries returns the cached builds selected by the filter flags
+func cacheEntries(conf *config.Config, r *cacheFilterFlags) ([]jenkins.CacheEntry, error) {
+	entries, err := configCache(conf).Entries()
+	if err != nil {
+		return nil, err
+	}
+	flags := filterFlags{FilterRunner: r.FilterRunner, FilterJob: r.FilterJob,
+		FilterBuild: r.FilterBuild}
+	selected := entries[:0]
+	for _, entry := range entries {
+		job := config.Job{Runner: entry.Runner, JobName: entry.Job,
+			BuildNumber: entry.Build}
+		matched, err := multiFilter(&flags, &job, filterByRunnerName,
+			filterByJobName, filterByBuildNumber)
+		if err != nil {
+			return nil, err
+		} else if matched {
+			selected = append(selected, entry)
+		}
+	}
+	return selected, nil
+}
+
+// formatSize returns a byte count in human readable units, e.g. "1.5M"
+func formatSize(size int64) string {
+	const units = "KMGTP"
+	if size < 1024 {
+		return fmt.Sprintf("%dB", size)
+	}
+	value, unit := float64(size)/1024, 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f%c", value, units[unit])
+}
+
+// parseSize parses a byte count with an optional K, M, G or T suffix
+func parseSize(value string) (int64, error) {
+	multiplier := int64(1)
+	number := strings.ToUpper(strings.TrimSuffix(value, "B"))
+	if n := len(number); n > 0 {
+		if i := strings.IndexByte("KMGT", number[n-1]); i >= 0 {
+			multiplier = 1 << (10 * uint(i+1))
+			number = number[:n-1]
+		}
+	}
+	size, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", value)
+	}
+	return size * multiplier, nil
+}
+
+// parseAge parses a duration that may also be given in days, e.g. "30d"
+func parseAge(value string) (time.Duration, error) {
+	if days := strings.TrimSuffix(value, "d"); days != value {
+		n, err := strconv.Atoi(days)
+		if err == nil && n >= 0 {
+			return time.Duration(n) * 24 * time.Hour, nil
+		}
+	} else if age, err := time.ParseDuration(value); err == nil && age >= 0 {
+		return age, nil
+	}
+	return 0, fmt.Errorf("invalid age '%s'", value)
+}
+
+type cacheStatsCmd struct {
+	cacheFilterFlags
+}
+
+type cacheStats struct {
+	builds int
+	size   int64
+	oldest time.Time
+	newest time.Time
+}
+
+func (s *cacheStats) add(entry *jenkins.CacheEntry) {
+	s.builds++
+	s.size += entry.Size
+	if s.oldest.IsZero() || entry.Fetched.Before(s.oldest) {
+		s.oldest = entry.Fetched
+	}
+	if entry.Fetched.After(s.newest) {
+		s.newest = entry.Fetched
+	}
+}
+
+func (r *cacheStatsCmd) Execute(args []string) error {
+	conf, err := config.Load(globalFlags.ConfigFile)
+	if err != nil {
+		return err
+	}
+	entries, err := cacheEntries(conf, &r.cacheFilterFlags)
+	if err != nil {
+		return err
+	}
+	runners := make(map[string]*cacheStats)
+	jobs := make(map[[2]string]*cacheStats)
+	var total cacheStats
+	for i := range entries {
+		entry := &entries[i]
+		if runners[entry.Runner] == nil {
+			runners[entry.Runner] = &cacheStats{}
+		}
+		key := [2]string{entry.Runner, entry.Job}
+		if jobs[key] == nil {
+			jobs[key] = &cacheStats{}
+		}
+		runners[entry.Runner].add(entry)
+		jobs[key].add(entry)
+		total.add(entry)
+	}
+
+	fields := []string{"RUNNER", "JOB", "BUILDS", "SIZE", "OLDEST",
+		"NEWEST"}
+	write := func(output *tabout.TabOutput, runner, job string, stats *cacheStats) {
+		output.Write(map[string]string{
+			"RUNNER": runner, "JOB": job,
+			"BUILDS": strconv.Itoa(stats.builds),
+			"SIZE":   formatSize(stats.size),
+			"OLDEST": stats.oldest.Format("2006-01-02 15:04"),
+			"NEWEST": stats.newest.Format("2006-01-02 15:04"),
+		})
+	}
+	output := tabout.New(fields, nil)
+	keys := make([][2]string, 0, len(jobs))
+	for key := range jobs {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	for _, key := range keys {
+		write(output, key[0], key[1], jobs[key])
+	}
+	output.Flush()
+
+	fmt.Println()
+	output = tabout.New(fields, nil)
+	names := make([]string, 0, len(runners))
+	for name := range runners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		write(output, name, "*", runners[name])
+	}
+	if total.builds > 0 {
+		write(output, "*", "*", &total)
+	}
+	output.Flush()
+	return nil
+}
+
+type cacheGCCmd struct {
+	cacheFilterFlags
+	OlderThan string `long:"older-than" description:"Evict builds fetched longer ago than the given age, e.g. '30d' or '12h'"`
+	MaxSize   string `long:"max-size" description:"Evict the oldest builds until the cache fits in the given size, e.g. '500M'"`
+	Orphans   bool   `long:"orphans" description:"Evict builds that are neither in the job list nor in Jenkins anymore"`
+	DryRun    bool   `short:"n" long:"dry-run" description:"Only show what would be evicted"`
+}
+
+// orphanEntries returns the cached builds that are not in the job list
+// and no longer exist in Jenkins, a build only counts as deleted when the
+// build list of its job could be read
+func orphanEntries(conf *config.Config, entries []jenkins.CacheEntry) ([]jenkins.CacheEntry, error) {
+	listed := make(map[[3]string]bool)
+	for _, job := range conf.Jobs {
+		listed[[3]string{job.Runner, job.JobName, job.BuildNumber}] = true
+	}
+	remote := make(map[[2]string]map[string]bool)
+	var orphans []jenkins.CacheEntry
+	for _, entry := range entries {
+		if listed[[3]string{entry.Runner, entry.Job, entry.Build}] {
+			continue
+		}
+		if _, exists := conf.Runners[entry.Runner]; !exists {
+			orphans = append(orphans, entry) // runner was removed
+			continue
+		}
+		key := [2]string{entry.Runner, entry.Job}
+		builds, queried := remote[key]
+		if !queried {
+			jenk, err := getJenkins(conf, entry.Runner)
+			if err != nil {
+				return nil, err
+			}
+			numbers, err := jenk.QueryJobBuilds(globalContext,
+				entry.Job)
+			switch {
+			case errors.Is(err, jenkins.ErrNotFound):
+				// Jenkins answers 404 also for jobs that the
+				// runner credentials cannot read
+				return nil, fmt.Errorf("%s %s: job is deleted or "+
+					"not readable, use 'cache invalidate' to "+
+					"evict its builds", entry.Runner, entry.Job)
+			case err != nil:
+				return nil, fmt.Errorf("%s %s: %s", entry.Runner,
+					entry.Job, err)
+			default:
+				builds = make(map[string]bool, len(numbers))
+				for _, number := range numbers {
+					builds[number] = true
+				}
+			}
+			remote[key] = builds
+		}
+		if !builds[entry.Build] {
+			orphans = append(orphans, entry)
+		}
+	}
+	return orphans, nil
+}
+
+func (r *cacheGCCmd) Execute(args []string) error {
+	conf, err := config.Load(globalFlags.ConfigFile)
+	if err != nil {
+		return err
+	}
+	if r.OlderThan == "" && r.MaxSize == "" && !r.Orphans {
+		return fmt.Errorf(
+			"nothing to evict: use --older-than, --max-size or --orphans")
+	}
+	entries, err := cacheEntries(conf, &r.cacheFilterFlags)
+	if err != nil {
+		return err
+	}
+	// oldest first
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Fetched.Before(entries[j].Fetched)
+	})
+
+	evicted := make(map[jenkins.CacheEntry]string) // entry -> reason
+	if r.OlderThan != "" {
+		age, err := parseAge(r.OlderThan)
+		if err != nil {
+			return err
+		}
+		limit := time.Now().Add(-age)
+		for _, entry := range entries {
+			if entry.Fetched.Before(limit) {
+				evicted[entry] = "AGE"
+			}
+		}
+	}
+	if r.Orphans {
+		orphans, err := orphanEntries(conf, entries)
+		if err != nil {
+			return err
+		}
+		for _, entry := range orphans {
+			if _, exists := evicted[entry]; !exists {
+				evicted[entry] = "ORPHAN"
+			}
+		}
+	}
+	if r.MaxSize != "" {
+		maxSize, err := parseSize(r.MaxSize)
+		if err != nil {
+			return err
+		}
+		var size int64
+		for _, entry := range entries {
+			if _, exists := evicted[entry]; !exists {
+				size += entry.Size
+			}
+		}
+		for _, entry := range entries {
+			if size <= maxSize {
+				break
+			}
+			if _, exists := evicted[entry]; !exists {
+				evicted[entry] = "SIZE"
+				size -= entry.Size
+			}
+		}
+	}
+
+	cache := configCache(conf)
+	output := tabout.New([]string{"RUNNER", "JOB", "BUILD", "SIZE",
+		"REASON"}, nil)
+	var count int
+	var freed int64
+	for _, entry := range entries {
+		reason, exists := evicted[entry]
+		if !exists {
+			continue
+		}
+		if !r.DryRun {
+			err := cache.Remove(entry.Runner, entry.Job, entry.Build)
+			if err != nil {
+				return err
+			}
+		}
+		output.Write(map[string]string{
+			"RUNNER": entry.Runner, "JOB": entry.Job,
+			"BUILD": entry.Build, "SIZE": formatSize(entry.Size),
+			"REASON": reason,
+		})
+		count++
+		freed += entry.Size
+	}
+	output.Flush()
+	verb := "evicted"
+	if r.DryRun {
+		verb = "would evict"
+	} else if count > 0 {
+		if err := cache.Compact(); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("%s %d builds, %s\n", verb, count, formatSize(freed))
+	return nil
+}
+
+type cacheInvalidateCmd struct {
+	cacheFilterFlags
+	DryRun bool `short:"n" long:"dry-run" description:"Only show what would be invalidated"`
+}
+
+func (r *cacheInvalidateCmd) Execute(args []string) error {
+	conf, err := config.Load(globalFlags.ConfigFile)
+	if err != nil {
+		return err
+	}
+	entries, err := cacheEntries(conf, &r.cacheFilterFlags)
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := &entries[i], &entries[j]
+		if a.Runner != b.Runner {
+			return a.Runner < b.Runner
+		} else if a.Job != b.Job {
+			return a.Job < b.Job
+		} else if len(a.Build) != len(b.Build) {
+			return len(a.Build) < len(b.Build) // numeric order
+		}
+		return a.Build < b.Build
+	})
+	cache := configCache(conf)
+	output := tabout.New([]string{"RUNNER", "JOB", "BUILD", "FETCHED"}, nil)
+	for _, entry := range entries {
+		if !r.DryRun {
+			err := cache.Remove(entry.Runner, entry.Job, entry.Build)
+			if err != nil {
+				return err
+			}
+		}
+		output.Write(map[string]string{
+			"RUNNER": entry.Runner, "JOB": entry.Job,
+			"BUILD":   entry.Build,
+			"FETCHED": entry.Fetched.Format("2006-01-02 15:04"),
+		})
+	}
+	output.Flush()
+	verb := "invalidated"
+	if r.DryRun {
+		verb = "would invalidate"
+	}
+	fmt.Printf("%s %d builds\n", verb, len(entries))
+	return nil
+}
@@ -0,0 +1,226 @@
+package main
+
+/*
+Package tjob - Cache Export and Import Commands
+
+Copyright (c) 2014 Ohmu Ltd.
+Licensed under the Apache License, Version 2.0 (see LICENSE)
+*/
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/ohmu/tjob/config"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// cacheBundleFormat identifies the cache bundles, a gzipped stream of JSON
+// values: a cacheBundleHeader followed by a cacheBundleBuild per build
+const cacheBundleFormat = "tjob-cache-bundle/1"
+
+type cacheBundleHeader struct {
+	Format string
+	Jobs   []*config.Job `json:",omitempty"`
+}
+
+type cacheBundleBuild struct {
+	Runner  string
+	Job     string
+	Build   string
+	Fetched time.Time
+	Data    json.RawMessage // as stored in the cache
+}
+
+type cacheBundlePosArgs struct {
+	File string `description:"Bundle file, '-' for stdout or stdin"`
+}
+
+type cacheExportCmd struct {
+	cacheFilterFlags
+	Jobs               bool `long:"jobs" description:"Include the tracked jobs selected by the filters"`
+	cacheBundlePosArgs `positional-args:"yes" required:"yes"`
+}
+
+// jobKey identifies a tracked job
+func jobKey(job *config.Job) [4]string {
+	return [4]string{job.Runner, job.JobName, job.BuildNumber, job.QueueItem}
+}
+
+// selectedJobs returns the tracked jobs selected by the filter flags
+func selectedJobs(conf *config.Config, r *cacheFilterFlags) ([]*config.Job, error) {
+	flags := filterFlags{FilterRunner: r.FilterRunner, FilterJob: r.FilterJob,
+		FilterBuild: r.FilterBuild}
+	var jobs []*config.Job
+	for _, job := range conf.Jobs {
+		matched, err := multiFilter(&flags, job, filterByRunnerName,
+			filterByJobName, filterByBuildNumber)
+		if err != nil {
+			return nil, err
+		} else if matched {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs, nil
+}
+
+func writeCacheBundle(out io.Writer, conf *config.Config, r *cacheExportCmd) (int, error) {
+	header := cacheBundleHeader{Format: cacheBundleFormat}
+	if r.Jobs {
+		jobs, err := selectedJobs(conf, &r.cacheFilterFlags)
+		if err != nil {
+			return 0, err
+		}
+		header.Jobs = jobs
+	}
+	entries, err := cacheEntries(conf, &r.cacheFilterFlags)
+	if err != nil {
+		return 0, err
+	}
+	zipped := gzip.NewWriter(out)
+	encoder := json.NewEncoder(zipped)
+	if err := encoder.Encode(&header); err != nil {
+		return 0, err
+	}
+	cache := configCache(conf)
+	count := 0
+	for _, entry := range entries {
+		data, fetched, err := cache.Export(entry.Runner, entry.Job,
+			entry.Build)
+		if err != nil {
+			return 0, err
+		} else if data == nil {
+			continue // evicted meanwhile
+		}
+		err = encoder.Encode(&cacheBundleBuild{Runner: entry.Runner,
+			Job: entry.Job, Build: entry.Build, Fetched: fetched,
+			Data: data})
+		if err != nil {
+			return 0, err
+		}
+		count++
+	}
+	return count, zipped.Close()
+}
+
+func (r *cacheExportCmd) Execute(args []string) error {
+	conf, err := config.Load(globalFlags.ConfigFile)
+	if err != nil {
+		return err
+	}
+	out := os.Stdout
+	if r.File != "-" {
+		if out, err = os.Create(r.File); err != nil {
+			return err
+		}
+	}
+	count, err := writeCacheBundle(out, conf, r)
+	if r.File != "-" {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(r.File) // no partial bundles
+		}
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d builds\n", count)
+	return nil
+}
+
+type cacheImportCmd struct {
+	Jobs               bool `long:"jobs" description:"Also add the tracked jobs of the bundle to the job list"`
+	cacheBundlePosArgs `positional-args:"yes" required:"yes"`
+}
+
+// importJobs adds the jobs that are not tracked yet, skipping the jobs of
+// runners that are not configured
+func importJobs(conf *config.Config, jobs []*config.Job) (added int, missing []string) {
+	tracked := make(map[[4]string]bool, len(conf.Jobs))
+	for _, job := range conf.Jobs {
+		tracked[jobKey(job)] = true
+	}
+	unknown := make(map[string]bool)
+	for _, job := range jobs {
+		if _, exists := conf.Runners[job.Runner]; !exists {
+			unknown[job.Runner] = true
+		} else if !tracked[jobKey(job)] {
+			conf.Jobs = append(conf.Jobs, job)
+			tracked[jobKey(job)] = true
+			added++
+		}
+	}
+	for runner := range unknown {
+		missing = append(missing, runner)
+	}
+	sort.Strings(missing)
+	return added, missing
+}
+
+func (r *cacheImportCmd) Execute(args []string) error {
+	conf, err := config.Load(globalFlags.ConfigFile)
+	if err != nil {
+		return err
+	}
+	in := os.Stdin
+	if r.File != "-" {
+		if in, err = os.Open(r.File); err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+	zipped, err := gzip.NewReader(in)
+	if err != nil {
+		return fmt.Errorf("%s: not a cache bundle: %s", r.File, err)
+	}
+	decoder := json.NewDecoder(zipped)
+	var header cacheBundleHeader
+	if err := decoder.Decode(&header); err != nil ||
+		header.Format != cacheBundleFormat {
+		return fmt.Errorf("%s: not a cache bundle", r.File)
+	}
+
+	cache := configCache(conf)
+	imported, skipped := 0, 0
+	for {
+		var build cacheBundleBuild
+		err := decoder.Decode(&build)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("%s: %s", r.File, err)
+		}
+		stored, err := cache.Import(build.Runner, build.Job, build.Build,
+			build.Data, build.Fetched)
+		if err != nil {
+			return err
+		} else if stored {
+			imported++
+		} else {
+			skipped++
+		}
+	}
+	fmt.Printf("imported %d builds, skipped %d builds not newer than the cached ones\n",
+		imported, skipped)
+
+	if r.Jobs {
+		added, missing := importJobs(conf, header.Jobs)
+		if added > 0 {
+			if err := conf.Save(); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("added %d jobs\n", added)
+		if len(missing) > 0 {
+			return fmt.Errorf("skipped the jobs of runners that are not configured: %s",
+				strings.Join(missing, ", "))
+		}
+	}
+	return nil
+}
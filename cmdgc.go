@@ -0,0 +1,147 @@
+package main
+
+/*
+Package tjob - GC Command
+
+Copyright (c) 2014 Ohmu Ltd.
+Licensed under the Apache License, Version 2.0 (see LICENSE)
+*/
+
+import (
+	"bufio"
+	"code.google.com/p/go.crypto/ssh/terminal"
+	"errors"
+	"fmt"
+	"github.com/ohmu/tjob/config"
+	"github.com/ohmu/tjob/jenkins"
+	"github.com/ohmu/tjob/pipeline"
+	"github.com/ohmu/tjob/tabout"
+	"os"
+	"strings"
+)
+
+type gcJobsCmd struct {
+	filterFlags
+	UserConfirmed bool `long:"confirm" description:"Remove without asking for confirmation"`
+}
+
+// goneCollector collects builds that have been deleted from Jenkins, and
+// the errors of the jobs whose builds could not be checked
+type goneCollector struct {
+	pipeline.Node
+	conf   *config.Config
+	Input  chan *JobStatus
+	gone   []*JobStatus
+	failed []error
+}
+
+func (node *goneCollector) Run() error {
+	failedJobs := make(map[[2]string]bool) // reported once per job
+	for res := range node.Input {
+		job := [2]string{res.Runner, res.JobName}
+		if !errors.Is(res.err, jenkins.ErrNotFound) || failedJobs[job] {
+			continue
+		}
+		jenk, err := getJenkins(node.conf, res.Runner)
+		if err != nil {
+			return node.AbortWithError(err)
+		}
+		deleted, err := jenk.BuildDeleted(node.Context(), res.JobName,
+			res.BuildNumber)
+		switch {
+		case node.Context().Err() != nil:
+			return nil // interrupted, reported by the pipeline
+		case err != nil:
+			failedJobs[job] = true
+			node.failed = append(node.failed, fmt.Errorf("%s %s: %s",
+				res.Runner, res.JobName, err))
+		case deleted:
+			node.gone = append(node.gone, res)
+		}
+	}
+	return nil
+}
+
+// askConfirmation asks a yes/no question on the terminal
+func askConfirmation(question string) (bool, error) {
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return false, fmt.Errorf("%s: use --confirm", question)
+	}
+	fmt.Printf("%s [y/N] ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false, err
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
+
+func (r *gcJobsCmd) Execute(args []string) error {
+	conf, err := config.Load(globalFlags.ConfigFile)
+	if err != nil {
+		return err
+	}
+
+	nodes, selected, collected := selectedBuilds(conf, &r.filterFlags)
+	collected.display = &displayOptions{} // report the query progress
+	gone := goneCollector{Input: selected, conf: conf}
+	errors := pipeline.Wait(globalContext, append(nodes, &gone)...)
+	removed := false
+	err = handleErrors(errors)
+	for _, jobErr := range gone.failed {
+		fmt.Println("error:", jobErr)
+	}
+	if err == nil {
+		removed, err = r.removeGone(conf, gone.gone)
+	}
+	if removed || collected.resolved > 0 {
+		// also keeps the build numbers of resolved queued builds
+		if saveErr := conf.Save(); saveErr != nil {
+			return saveErr
+		}
+	}
+	if err == nil && len(gone.failed) > 0 {
+		err = fmt.Errorf("could not check the builds of %d jobs",
+			len(gone.failed))
+	}
+	return err
+}
+
+// removeGone removes the deleted builds from the job list after showing
+// them and asking for a confirmation, it tells whether any were removed
+func (r *gcJobsCmd) removeGone(conf *config.Config, gone []*JobStatus) (bool, error) {
+	if len(gone) == 0 {
+		fmt.Println("no deleted builds found")
+		return false, nil
+	}
+	output := tabout.New([]string{"RUNNER", "JOB", "BUILD", "TAGS",
+		"ERROR"}, nil)
+	for _, res := range gone {
+		output.Write(map[string]string{
+			"RUNNER": res.Runner, "JOB": res.JobName,
+			"BUILD": res.BuildNumber,
+			"TAGS":  strings.Join(res.Tags, ","),
+			"ERROR": res.err.Error(),
+		})
+	}
+	output.Flush()
+
+	if !r.UserConfirmed {
+		confirmed, err := askConfirmation(fmt.Sprintf(
+			"remove %d deleted builds", len(gone)))
+		if err != nil || !confirmed {
+			return false, err
+		}
+	}
+	removed := make(map[*config.Job]bool)
+	for _, res := range gone {
+		removed[res.Job] = true
+	}
+	for i := len(conf.Jobs) - 1; i >= 0; i-- {
+		if removed[conf.Jobs[i]] {
+			conf.Jobs = append(conf.Jobs[:i], conf.Jobs[i+1:]...)
+		}
+	}
+	fmt.Printf("removed %d builds\n", len(removed))
+	return true, nil
+}
@@ -0,0 +1,289 @@
+package main
+
+/*
+Package tjob - Graph Command
+
+Copyright (c) 2014 Ohmu Ltd.
+Licensed under the Apache License, Version 2.0 (see LICENSE)
+*/
+
+import (
+	"context"
+	"fmt"
+	"github.com/ohmu/tjob/config"
+	"github.com/ohmu/tjob/jenkins"
+	"github.com/ohmu/tjob/pipeline"
+)
+
+type graphJobsCmd struct {
+	filterFlags
+	DotOutput  bool `long:"dot" description:"Output the graph in Graphviz DOT format"`
+	MaxDepth   int  `long:"depth" default:"10" description:"Max number of upstream and downstream levels to follow"`
+	Promotions bool `long:"promotions" description:"Also show the promotion builds triggered by the builds"`
+}
+
+type buildCollector struct {
+	pipeline.Node
+	Input  chan *JobStatus
+	builds []*JobStatus
+}
+
+func (node *buildCollector) Run() error {
+	for res := range node.Input {
+		if res.err == nil && !res.IsQueued() {
+			node.builds = append(node.builds, res)
+		}
+	}
+	return nil
+}
+
+type graphNode struct {
+	runner    string
+	ref       jenkins.BuildRef
+	promotion string // promotion process name for promotion builds
+	status    *jenkins.JobStatus
+	err       error
+	selected  bool
+	parents   []*graphNode
+	children  []*graphNode
+}
+
+func (n *graphNode) key() string {
+	if n.promotion != "" {
+		return n.runner + " " + n.ref.JobName + " promotion " +
+			n.promotion + " #" + n.ref.BuildNumber
+	}
+	return n.runner + " " + n.ref.JobName + " #" + n.ref.BuildNumber
+}
+
+func (n *graphNode) state() string {
+	switch {
+	case n.err != nil:
+		return "ERROR: " + n.err.Error()
+	case n.status.Building:
+		return "RUNNING"
+	}
+	return n.status.Result
+}
+
+func (n *graphNode) addChild(child *graphNode) {
+	for _, existing := range n.children {
+		if existing == child {
+			return
+		}
+	}
+	n.children = append(n.children, child)
+	child.parents = append(child.parents, n)
+}
+
+// buildGraph is built from the selected builds by following the upstream
+// causes up and the downstream projects and promotions down
+type buildGraph struct {
+	ctx        context.Context
+	conf       *config.Config
+	maxDepth   int
+	promotions bool
+	nodes      map[string]*graphNode
+	order      []*graphNode // in the order of discovery
+	expanded   map[*graphNode]bool
+}
+
+func (g *buildGraph) node(runner string, ref jenkins.BuildRef) *graphNode {
+	n := &graphNode{runner: runner, ref: ref}
+	if existing, ok := g.nodes[n.key()]; ok {
+		return existing
+	}
+	g.nodes[n.key()] = n
+	g.order = append(g.order, n)
+	jenk, err := getJenkins(g.conf, runner)
+	if err == nil {
+		n.status, err = jenk.QueryJobStatus(g.ctx, ref.JobName,
+			ref.BuildNumber, false)
+	}
+	n.err = err
+	return n
+}
+
+// root walks up the upstream builds and returns the topmost one
+func (g *buildGraph) root(n *graphNode) *graphNode {
+	for depth := 0; depth < g.maxDepth && n.err == nil; depth++ {
+		if len(n.status.XUpstream) == 0 {
+			break
+		}
+		var parent *graphNode
+		for _, ref := range n.status.XUpstream {
+			upstream := g.node(n.runner, ref)
+			upstream.addChild(n)
+			if parent == nil {
+				parent = upstream
+			}
+		}
+		n = parent
+	}
+	return n
+}
+
+// promotionNode returns the node of a promotion build, its status comes
+// with the promotion list
+func (g *buildGraph) promotionNode(runner, jobName string, promotion jenkins.Promotion) *graphNode {
+	n := &graphNode{runner: runner, promotion: promotion.Process,
+		ref: jenkins.BuildRef{JobName: jobName,
+			BuildNumber: promotion.BuildNumber},
+		status: promotion.Status}
+	if existing, ok := g.nodes[n.key()]; ok {
+		return existing
+	}
+	g.nodes[n.key()] = n
+	g.order = append(g.order, n)
+	return n
+}
+
+// expand adds the downstream builds and promotions below n, the builds
+// triggered by promotions are not followed
+func (g *buildGraph) expand(n *graphNode, depth int) {
+	if depth >= g.maxDepth || n.err != nil || n.promotion != "" ||
+		g.expanded[n] {
+		return
+	}
+	g.expanded[n] = true
+	jenk, err := getJenkins(g.conf, n.runner)
+	if err != nil {
+		n.err = err
+		return
+	}
+	refs, err := jenk.QueryDownstreamBuilds(g.ctx, n.ref.JobName,
+		n.ref.BuildNumber)
+	if err != nil {
+		n.err = err
+		return
+	}
+	for _, ref := range refs {
+		n.addChild(g.node(n.runner, ref))
+	}
+	if g.promotions {
+		promotions, err := jenk.QueryPromotions(g.ctx, n.ref.JobName,
+			n.ref.BuildNumber)
+		if err != nil {
+			n.err = err
+			return
+		}
+		for _, promotion := range promotions {
+			n.addChild(g.promotionNode(n.runner, n.ref.JobName,
+				promotion))
+		}
+	}
+	for _, child := range n.children {
+		g.expand(child, depth+1)
+	}
+}
+
+func (g *buildGraph) printTree(n *graphNode, indent string, last bool, isRoot bool, printed map[*graphNode]bool) {
+	branch, childIndent := "", ""
+	if !isRoot {
+		branch, childIndent = "├── ", "│   "
+		if last {
+			branch, childIndent = "└── ", "    "
+		}
+	}
+	line := indent + branch + n.key() + " " + n.state()
+	if n.selected {
+		line += " *"
+	}
+	if printed[n] {
+		fmt.Println(line + " (see above)")
+		return
+	}
+	fmt.Println(line)
+	printed[n] = true
+	for i, child := range n.children {
+		g.printTree(child, indent+childIndent,
+			i == len(n.children)-1, false, printed)
+	}
+}
+
+func dotColor(n *graphNode) string {
+	switch {
+	case n.err != nil:
+		return "gray"
+	case n.status.Building:
+		return "blue"
+	case n.status.Result == "SUCCESS":
+		return "green"
+	case n.status.Result == "UNSTABLE":
+		return "orange"
+	case n.status.Result == "FAILURE":
+		return "red"
+	}
+	return "gray"
+}
+
+func (g *buildGraph) printDot() {
+	fmt.Println("digraph builds {")
+	for _, n := range g.order {
+		style := ""
+		if n.selected {
+			style = ", penwidth=3"
+		}
+		fmt.Printf("\t%q [label=%q, color=%s%s];\n", n.key(),
+			n.key()+"\n"+n.state(), dotColor(n), style)
+	}
+	for _, n := range g.order {
+		for _, child := range n.children {
+			fmt.Printf("\t%q -> %q;\n", n.key(), child.key())
+		}
+	}
+	fmt.Println("}")
+}
+
+func (r *graphJobsCmd) Execute(args []string) error {
+	conf, err := config.Load(globalFlags.ConfigFile)
+	if err != nil {
+		return err
+	}
+	nodes, selected, _ := selectedBuilds(conf, &r.filterFlags)
+	collected := buildCollector{Input: selected}
+	errors := pipeline.Wait(globalContext, append(nodes, &collected)...)
+	if err := handleErrors(errors); err != nil {
+		return err
+	}
+
+	graph := buildGraph{ctx: globalContext, conf: conf,
+		maxDepth: r.MaxDepth, promotions: r.Promotions,
+		nodes:    make(map[string]*graphNode),
+		expanded: make(map[*graphNode]bool)}
+	var roots []*graphNode
+	seenRoots := make(map[*graphNode]bool)
+	for _, res := range collected.builds {
+		n := graph.node(res.Runner, jenkins.BuildRef{
+			JobName: res.JobName, BuildNumber: res.BuildNumber})
+		n.selected = true
+		root := graph.root(n)
+		if !seenRoots[root] {
+			seenRoots[root] = true
+			roots = append(roots, root)
+		}
+	}
+	for _, root := range roots {
+		graph.expand(root, 0)
+	}
+	if globalContext.Err() != nil {
+		return fmt.Errorf("interrupted")
+	}
+
+	if r.DotOutput {
+		graph.printDot()
+		return nil
+	}
+	if len(roots) == 0 {
+		fmt.Println("no builds selected")
+		return nil
+	}
+	printed := make(map[*graphNode]bool)
+	for i, root := range roots {
+		if i > 0 {
+			fmt.Println()
+		}
+		graph.printTree(root, "", true, true, printed)
+	}
+	return nil
+}
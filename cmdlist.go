@@ -47,6 +47,7 @@ func (r *listJobsCmd) Execute(args []string) error {
 		templateFile = path.Join(path.Dir(globalFlags.ConfigFile),
 			r.TemplateName)
 	}
+	r.displayOptions.templated = templateFile != ""
 	collected := jobStatusQuery{Input: preFiltered.Output,
 		Output: make(chan *JobStatus, 10), conf: conf,
 		display: &r.displayOptions}
@@ -81,7 +82,15 @@ func (r *listJobsCmd) Execute(args []string) error {
 			display: &r.displayOptions}
 		displayedUp = &displayed
 	}
-	errors := pipeline.Wait(jobsUp, &preFiltered, &collected, sortedUp,
-		&postFiltered, displayedUp)
-	return handleErrors(errors)
+	errors := pipeline.Wait(globalContext, jobsUp, &preFiltered,
+		&collected, sortedUp, &postFiltered, displayedUp)
+	err = handleErrors(errors)
+	if collected.resolved > 0 {
+		// remember the build numbers of builds that left the queue,
+		// even when interrupted
+		if saveErr := conf.Save(); saveErr != nil {
+			return saveErr
+		}
+	}
+	return err
 }
@@ -30,7 +30,8 @@ func (node *jobRemover) Run() error {
 			job := node.conf.Jobs[i]
 			if job.Runner == res.Runner &&
 				job.JobName == res.JobName &&
-				job.BuildNumber == res.BuildNumber {
+				job.BuildNumber == res.BuildNumber &&
+				job.QueueItem == res.QueueItem {
 				fmt.Printf("removed %s %s %s\n",
 					job.Runner, job.JobName, job.BuildNumber)
 				node.conf.Jobs = append(node.conf.Jobs[:i], node.conf.Jobs[i+1:]...)
@@ -46,23 +47,10 @@ func (r *removeJobsCmd) Execute(args []string) error {
 		return err
 	}
 
-	var jobs chan *config.Job
-	jobber := configJobSender{Output: make(chan *config.Job, 10), conf: conf}
-	jobs = jobber.Output
-	preFiltered := jobFilterer{Input: jobs,
-		Output: make(chan *config.Job, 10), flags: &r.filterFlags}
-	collected := jobStatusQuery{Input: preFiltered.Output,
-		Output: make(chan *JobStatus, 10), conf: conf,
-		display: &displayOptions{}}
-
-	// post-query filtering that requires build results in a slice
-	postFiltered := resultFilterer{Input: collected.Output,
-		Output: make(chan *JobStatus, 10), flags: &r.filterFlags,
-		display: &displayOptions{}}
-
-	removed := jobRemover{Input: postFiltered.Output, conf: conf}
-	errors := pipeline.Wait(&jobber, &preFiltered, &collected, &postFiltered,
-		&removed)
+	nodes, selected, collected := selectedBuilds(conf, &r.filterFlags)
+	collected.display = &displayOptions{} // report the query progress
+	removed := jobRemover{Input: selected, conf: conf}
+	errors := pipeline.Wait(globalContext, append(nodes, &removed)...)
 	if err := handleErrors(errors); err != nil {
 		return err
 	}
@@ -0,0 +1,71 @@
+package main
+
+/*
+Package tjob - Resolve Command
+
+Copyright (c) 2014 Ohmu Ltd.
+Licensed under the Apache License, Version 2.0 (see LICENSE)
+*/
+
+import (
+	"fmt"
+	"github.com/ohmu/tjob/config"
+	"github.com/ohmu/tjob/jenkins"
+	"github.com/ohmu/tjob/tabout"
+)
+
+type resolveJobsCmd struct{}
+
+func (r *resolveJobsCmd) Execute(args []string) error {
+	conf, err := config.Load(globalFlags.ConfigFile)
+	if err != nil {
+		return err
+	}
+	output := tabout.New([]string{"RUNNER", "JOB", "QUEUE-ITEM", "BUILD",
+		"STATUS"}, nil)
+	errCount := 0
+	for i := len(conf.Jobs) - 1; i >= 0; i-- {
+		job := conf.Jobs[i]
+		if !job.IsQueued() {
+			continue
+		}
+		if globalContext.Err() != nil {
+			break // save the ones resolved so far
+		}
+		jenk, err := getJenkins(conf, job.Runner)
+		if err != nil {
+			return err
+		}
+		queueItem := job.QueueItem
+		buildNumber, err := jenk.ResolveQueueItem(globalContext,
+			job.JobName, queueItem)
+		var state string
+		switch {
+		case err == jenkins.ErrQueueItemCancelled:
+			state = "CANCELLED, removed"
+			conf.Jobs = append(conf.Jobs[:i], conf.Jobs[i+1:]...)
+		case err != nil:
+			state = "ERROR: " + err.Error()
+			errCount++
+		case buildNumber == "":
+			state = "QUEUED"
+		default:
+			state = "STARTED"
+			job.BuildNumber = buildNumber
+			job.QueueItem = ""
+		}
+		output.Write(map[string]string{
+			"RUNNER": job.Runner, "JOB": job.JobName,
+			"QUEUE-ITEM": queueItem, "BUILD": buildNumber,
+			"STATUS": state,
+		})
+	}
+	output.Flush()
+	if err := conf.Save(); err != nil {
+		return err
+	}
+	if errCount > 0 {
+		return fmt.Errorf("failed to resolve %d queued builds", errCount)
+	}
+	return nil
+}
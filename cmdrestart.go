@@ -23,9 +23,7 @@ func (r *restartJobCmd) Execute(args []string) error {
 	if err != nil {
 		return err
 	}
-	jobs := configJobSender{Output: make(chan *config.Job, 10), conf: conf}
-	preFiltered := jobFilterer{Input: jobs.Output,
-		Output: make(chan *config.Job, 10), flags: &r.filterFlags}
+	nodes, selected, _ := selectedBuilds(conf, &r.filterFlags)
 	// TODO: channel-capable --confirm limit enforcement
 	/*
 		confirmLimit := 10
@@ -34,22 +32,15 @@ func (r *restartJobCmd) Execute(args []string) error {
 				confirmLimit, count)
 		}
 	*/
-	collected := jobStatusQuery{Input: preFiltered.Output,
-		Output: make(chan *JobStatus, 10), conf: conf,
-		display: &displayOptions{NoSorting: true}}
-	sorter := jobStatusSorter{Input: collected.Output,
-		Output: make(chan *JobStatus, 10)}
-	postFiltered := resultFilterer{Input: sorter.Output,
-		Output: make(chan *JobStatus, 10), flags: &r.filterFlags,
-		display: &displayOptions{NoSorting: true}}
-	jobCopies := jobCopier{Input: postFiltered.Output,
+	jobCopies := jobCopier{Input: selected,
 		Output: make(chan *config.Job, 10), Options: r.Option,
 		Tags: expandTags(r.Tags)}
 	started := jobStarter{Input: jobCopies.Output,
-		Output: make(chan *config.Job, 10), conf: conf}
+		Output: make(chan *config.Job, 10), conf: conf,
+		queueWait: r.QueueWait}
 	results := startResultPrinter{Input: started.Output,
 		Output: make(chan *config.Job, 10), conf: conf}
-	errors := pipeline.Wait(&jobs, &preFiltered, &collected, &sorter,
-		&postFiltered, &jobCopies, &started, &results)
+	errors := pipeline.Wait(globalContext, append(nodes, &jobCopies,
+		&started, &results)...)
 	return handleErrors(errors)
 }
@@ -8,12 +8,17 @@ Licensed under the Apache License, Version 2.0 (see LICENSE)
 */
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/ohmu/tjob/config"
+	"github.com/ohmu/tjob/jenkins"
 	"github.com/ohmu/tjob/pipeline"
 	"github.com/ohmu/tjob/sshcmd"
 	"net/url"
+	"os"
 	"strings"
+	"time"
 )
 
 type runJobPosArgs struct {
@@ -25,6 +30,7 @@ type runJobFlags struct {
 	Option    map[string]string `short:"O" long:"set-option" description:"Set option for the build: 'key:value'"`
 	Tags      []string          `short:"T" long:"set-tag" description:"Set tags for the build"`
 	NumBuilds int               `short:"n" default:"1" description:"Number of builds to start"`
+	QueueWait time.Duration     `long:"queue-wait" default:"1m" description:"Max time to wait for a build to leave the queue before recording it as queued"`
 }
 
 type runJobCmd struct {
@@ -32,7 +38,60 @@ type runJobCmd struct {
 	runJobPosArgs `positional-args:"yes" required:"yes"`
 }
 
-func startJob(runner *config.Runner, job *config.Job) (*config.Job, error) {
+// startJob starts a build, ctx only cuts short the wait for a build number
+// since a start request cancelled halfway would leave an unknown build
+func startJob(ctx context.Context, conf *config.Config, job *config.Job, queueWait time.Duration) (*config.Job, error) {
+	runner, exists := conf.Runners[job.Runner]
+	if !exists {
+		return nil, fmt.Errorf("runner '%s' does not exist", job.Runner)
+	}
+	switch runner.StartMethod {
+	case "", config.StartHTTP:
+		return startJobHTTP(ctx, conf, job, queueWait)
+	case config.StartSSH:
+		if globalFlags.Offline {
+			return nil, jenkins.ErrOffline
+		}
+		return startJobSSH(context.WithoutCancel(ctx), runner, job)
+	default:
+		return nil, fmt.Errorf("runner '%s' has unknown start method '%s'",
+			job.Runner, runner.StartMethod)
+	}
+}
+
+// startJobHTTP returns a queued job (empty BuildNumber) when Jenkins does
+// not start the build within queueWait
+func startJobHTTP(ctx context.Context, conf *config.Config, job *config.Job, queueWait time.Duration) (*config.Job, error) {
+	jenk, err := getJenkins(conf, job.Runner)
+	if err != nil {
+		return nil, err
+	}
+	buildNumber, queueItem, err := jenk.StartBuild(ctx, job.JobName,
+		job.Options, queueWait)
+	if err != nil && (queueItem == "" ||
+		errors.Is(err, jenkins.ErrQueueItemCancelled)) {
+		return nil, fmt.Errorf(
+			"job %s start failed: %s", job.JobName, err)
+	} else if err != nil {
+		// queued all the same, record it to be resolved later
+		fmt.Fprintf(os.Stderr,
+			"job %s queue item %s: build number not known yet: %s\n",
+			job.JobName, queueItem, err)
+		buildNumber = ""
+	}
+	started := &config.Job{Runner: job.Runner, JobName: job.JobName,
+		BuildNumber: buildNumber, Options: job.Options, Tags: job.Tags}
+	if buildNumber == "" {
+		started.QueueItem = queueItem
+	}
+	return started, nil
+}
+
+// defaultSSHPort is the Jenkins SSH CLI port used when neither the runner
+// nor ~/.ssh/config sets one
+const defaultSSHPort = 54410
+
+func startJobSSH(ctx context.Context, runner *config.Runner, job *config.Job) (*config.Job, error) {
 	url, err := url.Parse(runner.URL)
 	if err != nil {
 		return nil, fmt.Errorf(
@@ -41,16 +100,17 @@ func startJob(runner *config.Runner, job *config.Job) (*config.Job, error) {
 	// url.Host may funnily be "host:port"
 	host := strings.Split(url.Host, ":")[0]
 	ssh := sshcmd.SSHNode{Host: host, Port: runner.SSHPort,
-		User: runner.User, Key: runner.SSHKey}
+		DefaultPort: defaultSSHPort, User: runner.User,
+		Key: runner.SSHKey}
 	optStr := ""
 	for key, value := range job.Options {
 		optStr += fmt.Sprintf(" -p %s=%s", key, value)
 	}
 	cmd := fmt.Sprintf("build %s -w%s", job.JobName, optStr)
-	// TODO: jenkins does not handle simultaneous parallel requests properly,
-	// it may return the same build number for two different requests,
-	// do something about it...
-	resp, err := ssh.Execute(cmd)
+	// NOTE: jenkins does not handle simultaneous parallel CLI requests
+	// properly, it may return the same build number for two different
+	// requests, the HTTP start method does not have this problem
+	resp, err := ssh.Execute(ctx, cmd)
 	if err != nil {
 		return nil, fmt.Errorf(
 			"job %s start failed: %s: %s", job.JobName, err,
@@ -65,8 +125,9 @@ func startJob(runner *config.Runner, job *config.Job) (*config.Job, error) {
 			"job %s start failed: %s: %s", job.JobName, err,
 			resp)
 	}
-	return &config.Job{job.Runner, job.JobName, buildNumber,
-		job.Options, job.Tags}, nil
+	return &config.Job{Runner: job.Runner, JobName: job.JobName,
+		BuildNumber: buildNumber, Options: job.Options,
+		Tags: job.Tags}, nil
 }
 
 func expandTags(tags []string) []string {
@@ -87,14 +148,15 @@ func (r *runJobCmd) Execute(args []string) error {
 	start := make(chan *config.Job, r.NumBuilds*len(r.JobNames))
 	for nBuild := 0; nBuild < r.NumBuilds; nBuild++ {
 		for _, jobName := range r.JobNames {
-			start <- &config.Job{r.RunnerID, jobName, "", r.Option, expandTags(r.Tags)}
+			start <- &config.Job{Runner: r.RunnerID, JobName: jobName,
+				Options: r.Option, Tags: expandTags(r.Tags)}
 		}
 	}
 	close(start)
 	started := jobStarter{Input: start, Output: make(chan *config.Job, 10),
-		conf: conf}
+		conf: conf, queueWait: r.QueueWait}
 	results := startResultPrinter{Input: started.Output,
 		Output: make(chan *config.Job, 10), conf: conf}
-	errors := pipeline.Wait(&started, &results)
+	errors := pipeline.Wait(globalContext, &started, &results)
 	return handleErrors(errors)
 }
@@ -13,8 +13,12 @@ import (
 	"github.com/ohmu/tjob/jenkins"
 	"github.com/ohmu/tjob/sshcmd"
 	"github.com/ohmu/tjob/tabout"
+	"io/ioutil"
 	"path"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 // TODO: go-flags support for forcing a lower-case struct to be processed (anonymous members)
@@ -34,12 +38,27 @@ type runnerPosArgs struct {
 
 // TODO: go-flags support for positional args without the extra struct
 type runnerIDCmd struct {
-	URL           string `long:"url" description:"Jenkins URL"`
-	User          string `long:"user" description:"Jenkins/SSH username"`
-	SSHPort       int    `long:"ssh-port" description:"Jenkins SSH port"`
-	SSHKey        string `long:"ssh-key" description:"Jenkins SSH private key"`
-	Insecure      string `long:"insecure" description:"Skip TLS server cert validation"`
-	runnerPosArgs `positional-args:"yes" required:"yes"`
+	URL               string        `long:"url" description:"Jenkins URL"`
+	User              string        `long:"user" description:"Jenkins/SSH username"`
+	SSHPort           int           `long:"ssh-port" description:"Jenkins SSH port, defaults to the Port of ~/.ssh/config or 54410"`
+	SSHKey            string        `long:"ssh-key" description:"Jenkins SSH private key, tried after the ssh-agent keys and before the ~/.ssh/config identity files"`
+	Insecure          string        `long:"insecure" description:"Skip TLS server cert validation"`
+	StartMethod       string        `long:"start-method" description:"Build start method: 'http' (default) or 'ssh'"`
+	APIUser           string        `long:"api-user" description:"Jenkins HTTP API user, defaults to --user"`
+	APIToken          string        `long:"api-token" description:"Jenkins HTTP API token, stored in the config file, prefer --api-token-file"`
+	APITokenFile      string        `long:"api-token-file" description:"File containing the Jenkins HTTP API token"`
+	ConnectTimeout    time.Duration `long:"connect-timeout" description:"HTTP connect and TLS handshake timeout"`
+	ReadTimeout       time.Duration `long:"read-timeout" description:"HTTP response header timeout"`
+	Timeout           time.Duration `long:"timeout" description:"HTTP request total timeout"`
+	Retries           string        `long:"retries" description:"Number of retries for failed HTTP GET requests"`
+	CACert            string        `long:"ca-cert" description:"PEM file of CA certificates trusted for the Jenkins server"`
+	ClientCert        string        `long:"client-cert" description:"PEM file of the TLS client certificate"`
+	ClientKey         string        `long:"client-key" description:"PEM file of the TLS client certificate key"`
+	Proxy             string        `long:"proxy" description:"HTTP(S) proxy URL, defaults to the HTTP(S)_PROXY environment"`
+	NoProxy           string        `long:"no-proxy" description:"Connect directly, ignoring the HTTP(S)_PROXY environment"`
+	MaxConcurrency    int           `long:"max-concurrency" description:"Maximum number of parallel HTTP requests"`
+	RequestsPerSecond float64       `long:"requests-per-second" description:"Maximum rate of HTTP requests, unlimited by default"`
+	runnerPosArgs     `positional-args:"yes" required:"yes"`
 }
 
 type runnerAddCmd runnerIDCmd
@@ -54,11 +73,8 @@ func (r *runnerAddCmd) Execute(args []string) error {
 			"runner '%s' already exists, use the 'runner update' command",
 			r.RunnerID)
 	}
-	sshPortInt := 54410
-	if r.SSHPort != 0 {
-		sshPortInt = r.SSHPort
-	}
-	sshPort := sshcmd.SSHPort(sshPortInt)
+	// zero leaves the port to ~/.ssh/config and defaultSSHPort
+	sshPort := sshcmd.SSHPort(r.SSHPort)
 	insecureStr := "false"
 	if r.Insecure != "" {
 		insecureStr = r.Insecure
@@ -67,14 +83,36 @@ func (r *runnerAddCmd) Execute(args []string) error {
 	if err != nil {
 		return err
 	}
-	sshKey := "id_rsa"
-	if r.SSHKey != "" {
-		sshKey = r.SSHKey
+	if err := checkStartMethod(r.StartMethod); err != nil {
+		return err
+	}
+	retries, err := parseRetries(r.Retries)
+	if err != nil {
+		return err
+	}
+	if err := checkLimits(r.MaxConcurrency, r.RequestsPerSecond); err != nil {
+		return err
+	}
+	noProxy := false
+	if r.NoProxy != "" {
+		if noProxy, err = strconv.ParseBool(r.NoProxy); err != nil {
+			return err
+		}
+	}
+	runner := &config.Runner{
+		URL: r.URL, SSHPort: sshPort, SSHKey: r.SSHKey, User: r.User,
+		Insecure: insecure, StartMethod: r.StartMethod,
+		APIUser: r.APIUser, APIToken: r.APIToken,
+		APITokenFile: r.APITokenFile, ConnectTimeout: r.ConnectTimeout,
+		ReadTimeout: r.ReadTimeout, Timeout: r.Timeout, Retries: retries,
+		CACert: r.CACert, ClientCert: r.ClientCert, ClientKey: r.ClientKey,
+		Proxy: r.Proxy, NoProxy: noProxy,
+		MaxConcurrency: r.MaxConcurrency, RequestsPerSecond: r.RequestsPerSecond,
 	}
-	conf.Runners[r.RunnerID] = &config.Runner{
-		URL: r.URL, SSHPort: sshPort, SSHKey: sshKey, User: r.User,
-		Insecure: insecure,
+	if err := checkTransport(runner); err != nil {
+		return err
 	}
+	conf.Runners[r.RunnerID] = runner
 
 	return conf.Save()
 }
@@ -110,10 +148,124 @@ func (r *runnerUpdateCmd) Execute(args []string) error {
 		}
 		conf.Runners[r.RunnerID].Insecure = flag
 	}
+	if value := r.StartMethod; value != "" {
+		if err := checkStartMethod(value); err != nil {
+			return err
+		}
+		conf.Runners[r.RunnerID].StartMethod = value
+	}
+	if value := r.APIUser; value != "" {
+		conf.Runners[r.RunnerID].APIUser = value
+	}
+	if value := r.APIToken; value != "" {
+		conf.Runners[r.RunnerID].APIToken = value
+	}
+	if value := r.APITokenFile; value != "" {
+		conf.Runners[r.RunnerID].APITokenFile = value
+	}
+	if value := r.ConnectTimeout; value != 0 {
+		conf.Runners[r.RunnerID].ConnectTimeout = value
+	}
+	if value := r.ReadTimeout; value != 0 {
+		conf.Runners[r.RunnerID].ReadTimeout = value
+	}
+	if value := r.Timeout; value != 0 {
+		conf.Runners[r.RunnerID].Timeout = value
+	}
+	if value := r.Retries; value != "" {
+		retries, err := parseRetries(value)
+		if err != nil {
+			return err
+		}
+		conf.Runners[r.RunnerID].Retries = retries
+	}
+	if value := r.CACert; value != "" {
+		conf.Runners[r.RunnerID].CACert = value
+	}
+	if value := r.ClientCert; value != "" {
+		conf.Runners[r.RunnerID].ClientCert = value
+	}
+	if value := r.ClientKey; value != "" {
+		conf.Runners[r.RunnerID].ClientKey = value
+	}
+	if value := r.Proxy; value != "" {
+		conf.Runners[r.RunnerID].Proxy = value
+		conf.Runners[r.RunnerID].NoProxy = false
+	}
+	if value := r.NoProxy; value != "" {
+		flag, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		conf.Runners[r.RunnerID].NoProxy = flag
+		if flag {
+			conf.Runners[r.RunnerID].Proxy = ""
+		}
+	}
+	if err := checkTransport(conf.Runners[r.RunnerID]); err != nil {
+		return err
+	}
+	if err := checkLimits(r.MaxConcurrency, r.RequestsPerSecond); err != nil {
+		return err
+	}
+	if value := r.MaxConcurrency; value != 0 {
+		conf.Runners[r.RunnerID].MaxConcurrency = value
+	}
+	if value := r.RequestsPerSecond; value != 0 {
+		conf.Runners[r.RunnerID].RequestsPerSecond = value
+	}
 
 	return conf.Save()
 }
 
+func checkStartMethod(method string) error {
+	switch method {
+	case "", config.StartHTTP, config.StartSSH:
+		return nil
+	}
+	return fmt.Errorf("invalid start method '%s', use '%s' or '%s'",
+		method, config.StartHTTP, config.StartSSH)
+}
+
+// checkTransport validates the TLS and proxy settings of a runner
+func checkTransport(runner *config.Runner) error {
+	if (runner.ClientCert == "") != (runner.ClientKey == "") {
+		return fmt.Errorf(
+			"--client-cert and --client-key must be given together")
+	}
+	if runner.Proxy != "" && runner.NoProxy {
+		return fmt.Errorf("--proxy and --no-proxy=true conflict")
+	}
+	if runner.Proxy != "" {
+		if _, err := jenkins.ParseProxy(runner.Proxy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkLimits(maxConcurrency int, requestsPerSecond float64) error {
+	if maxConcurrency < 0 {
+		return fmt.Errorf("invalid max concurrency %d", maxConcurrency)
+	}
+	if requestsPerSecond < 0 {
+		return fmt.Errorf("invalid requests per second %g",
+			requestsPerSecond)
+	}
+	return nil
+}
+
+func parseRetries(value string) (*int, error) {
+	if value == "" {
+		return nil, nil
+	}
+	retries, err := strconv.Atoi(value)
+	if err != nil || retries < 0 {
+		return nil, fmt.Errorf("invalid retry count '%s'", value)
+	}
+	return &retries, nil
+}
+
 type runnerRemoveCmd runnerIDCmd
 
 func (r *runnerRemoveCmd) Execute(args []string) error {
@@ -137,27 +289,128 @@ func (r *runnerListCmd) Execute(args []string) error {
 		return err
 	}
 	output := tabout.New([]string{"NAME", "URL", "USER", "SSH-PORT",
-		"SSH-KEY", "INSECURE"}, nil)
+		"SSH-KEY", "INSECURE", "START", "API-USER", "API-TOKEN",
+		"CA-CERT", "CLIENT-CERT", "PROXY"}, nil)
 	for name, runner := range conf.Runners {
+		startMethod := runner.StartMethod
+		if startMethod == "" {
+			startMethod = config.StartHTTP
+		}
+		apiToken := "" // never show the token itself
+		switch {
+		case runner.APIToken != "":
+			apiToken = "(set)"
+		case runner.APITokenFile != "":
+			apiToken = runner.APITokenFile
+		}
+		proxy := runner.Proxy
+		if runner.NoProxy {
+			proxy = "(none)"
+		}
+		sshPort := "" // from ~/.ssh/config or the default
+		if runner.SSHPort != 0 {
+			sshPort = runner.SSHPort.String()
+		}
 		output.Write(map[string]string{
 			"NAME": name, "URL": runner.URL, "USER": runner.User,
-			"SSH-PORT": runner.SSHPort.String(),
+			"SSH-PORT": sshPort,
 			"SSH-KEY":  runner.SSHKey,
 			"INSECURE": strconv.FormatBool(runner.Insecure),
+			"START":    startMethod,
+			"API-USER": apiUser(runner), "API-TOKEN": apiToken,
+			"CA-CERT": runner.CACert, "CLIENT-CERT": runner.ClientCert,
+			"PROXY": proxy,
 		})
 	}
 	output.Flush()
 	return nil
 }
 
+func apiUser(runner *config.Runner) string {
+	if runner.APIUser != "" {
+		return runner.APIUser
+	}
+	return runner.User
+}
+
+func apiToken(conf *config.Config, runner *config.Runner) (string, error) {
+	if runner.APIToken != "" || runner.APITokenFile == "" {
+		return runner.APIToken, nil
+	}
+	data, err := ioutil.ReadFile(configPath(conf, runner.APITokenFile))
+	if err != nil {
+		return "", fmt.Errorf("failed to read API token: %s", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// configPath resolves a file path relative to the config directory
+func configPath(conf *config.Config, file string) string {
+	if file == "" || path.IsAbs(file) {
+		return file
+	}
+	return path.Join(conf.Dir(), file)
+}
+
+// one client per runner, shared by all the commands of the process so that
+// keep-alive connections get reused
+var globalJenkinsMutex sync.Mutex
+var globalJenkins = make(map[string]*jenkins.Jenkins)
+
 func getJenkins(conf *config.Config, runnerID string) (*jenkins.Jenkins, error) {
+	globalJenkinsMutex.Lock()
+	defer globalJenkinsMutex.Unlock()
+	if jenk, exists := globalJenkins[runnerID]; exists {
+		return jenk, nil
+	}
 	runner, exists := conf.Runners[runnerID]
 	if !exists {
 		return nil, fmt.Errorf(
 			"runner '%s' does not exist", runnerID)
 	}
-	jobCache := jenkins.JobCache{path.Join(conf.Dir(), "cache")}
+	token, err := apiToken(conf, runner)
+	if err != nil {
+		return nil, err
+	}
+	err = checkLimits(globalFlags.MaxConcurrency, globalFlags.RequestsPerSecond)
+	if err != nil {
+		return nil, err
+	}
 	jenk := jenkins.MakeJenkins(runnerID, runner.URL, runner.Insecure,
-		&jobCache)
+		configCache(conf))
+	jenk.User = apiUser(runner)
+	jenk.APIToken = token
+	if runner.ConnectTimeout != 0 {
+		jenk.ConnectTimeout = runner.ConnectTimeout
+	}
+	if runner.ReadTimeout != 0 {
+		jenk.ReadTimeout = runner.ReadTimeout
+	}
+	if runner.Timeout != 0 {
+		jenk.Timeout = runner.Timeout
+	}
+	if runner.Retries != nil {
+		jenk.Retries = *runner.Retries
+	}
+	jenk.CACertFile = configPath(conf, runner.CACert)
+	jenk.ClientCertFile = configPath(conf, runner.ClientCert)
+	jenk.ClientKeyFile = configPath(conf, runner.ClientKey)
+	jenk.Proxy = runner.Proxy
+	jenk.NoProxy = runner.NoProxy
+	jenk.Offline = globalFlags.Offline
+	// the global flags override the runner settings
+	switch {
+	case globalFlags.MaxConcurrency != 0:
+		jenk.MaxConcurrency = globalFlags.MaxConcurrency
+	case runner.MaxConcurrency != 0:
+		jenk.MaxConcurrency = runner.MaxConcurrency
+	}
+	switch {
+	case globalFlags.RequestsPerSecond != 0:
+		jenk.RequestsPerSecond = globalFlags.RequestsPerSecond
+	case runner.RequestsPerSecond != 0:
+		jenk.RequestsPerSecond = runner.RequestsPerSecond
+	}
+	globalJenkins[runnerID] = jenk
 	return jenk, nil
 }
@@ -0,0 +1,197 @@
+package main
+
+/*
+Package tjob - Tail Command
+
+Copyright (c) 2014 Ohmu Ltd.
+Licensed under the Apache License, Version 2.0 (see LICENSE)
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/ohmu/tjob/config"
+	"github.com/ohmu/tjob/pipeline"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type tailJobsCmd struct {
+	filterFlags
+	Include  string        `long:"include" description:"Show only lines matching a regular expression"`
+	Exclude  string        `long:"exclude" description:"Hide lines matching a regular expression"`
+	Interval time.Duration `long:"interval" default:"2s" description:"Console output polling interval"`
+	Finished bool          `long:"finished" description:"Also print the whole output of finished builds"`
+}
+
+type logLine struct {
+	prefix string
+	text   string
+}
+
+type logTailer struct {
+	pipeline.Node
+	conf     *config.Config
+	include  *regexp.Regexp
+	exclude  *regexp.Regexp
+	interval time.Duration
+	finished bool  // print finished builds too, not only running ones
+	failed   int32 // builds whose output could not be followed
+	followed int   // builds whose output was printed
+	Input    chan *JobStatus
+	Output   chan *logLine
+}
+
+func (node *logTailer) wanted(line string) bool {
+	if node.include != nil && !node.include.MatchString(line) {
+		return false
+	}
+	return node.exclude == nil || !node.exclude.MatchString(line)
+}
+
+// send returns false when the pipeline is being aborted
+func (node *logTailer) send(line *logLine) bool {
+	select {
+	case <-node.AbortChannel():
+		return false
+	case <-node.Context().Done():
+		return false
+	case node.Output <- line:
+		return true
+	}
+}
+
+// fail reports a build whose output could not be followed
+func (node *logTailer) fail(prefix string, err error) {
+	atomic.AddInt32(&node.failed, 1)
+	node.send(&logLine{prefix, "error: " + err.Error()})
+}
+
+// follow streams the console output of a build until it has finished
+func (node *logTailer) follow(res *JobStatus) {
+	prefix := fmt.Sprintf("%s %s %s:", res.Runner, res.JobName,
+		res.BuildNumber)
+	jenk, err := getJenkins(node.conf, res.Runner)
+	if err != nil {
+		node.fail(prefix, err)
+		return
+	}
+	var offset int64
+	var partial []byte // last line without a newline (yet)
+	for {
+		text, next, more, err := jenk.ProgressiveText(node.Context(),
+			res.JobName, res.BuildNumber, offset)
+		if node.Context().Err() != nil {
+			return // interrupted
+		}
+		if err != nil {
+			node.fail(prefix, err)
+			return
+		}
+		offset = next
+		lines := bytes.Split(append(partial, text...), []byte("\n"))
+		partial = lines[len(lines)-1]
+		if more || len(partial) == 0 {
+			lines = lines[:len(lines)-1]
+		} else {
+			partial = nil // build finished, flush everything
+		}
+		for _, line := range lines {
+			str := string(bytes.TrimRight(line, "\r"))
+			if node.wanted(str) && !node.send(&logLine{prefix, str}) {
+				return
+			}
+		}
+		if !more {
+			return
+		}
+		select {
+		case <-node.AbortChannel():
+			return
+		case <-node.Context().Done():
+			return
+		case <-time.After(node.interval):
+		}
+	}
+}
+
+func (node *logTailer) Run() error {
+	defer close(node.Output)
+	wg := sync.WaitGroup{}
+	for res := range node.Input {
+		prefix := fmt.Sprintf("%s %s %s:", res.Runner, res.JobName,
+			res.BuildNumber)
+		switch {
+		case res.err != nil:
+			node.fail(prefix, res.err)
+			continue
+		case res.IsQueued():
+			node.send(&logLine{prefix, "still queued, skipped"})
+			continue
+		case !res.Status.Building && !node.finished:
+			continue
+		}
+		node.followed++
+		wg.Add(1)
+		go func(res *JobStatus) {
+			defer wg.Done()
+			node.follow(res)
+		}(res)
+	}
+	wg.Wait()
+	return nil
+}
+
+type logLinePrinter struct {
+	pipeline.Node
+	Input chan *logLine
+}
+
+func (node *logLinePrinter) Run() error {
+	for line := range node.Input {
+		fmt.Println(line.prefix, line.text)
+	}
+	return nil
+}
+
+func compileOptional(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	return regexp.Compile(expr)
+}
+
+func (r *tailJobsCmd) Execute(args []string) error {
+	conf, err := config.Load(globalFlags.ConfigFile)
+	if err != nil {
+		return err
+	}
+	include, err := compileOptional(r.Include)
+	if err != nil {
+		return err
+	}
+	exclude, err := compileOptional(r.Exclude)
+	if err != nil {
+		return err
+	}
+
+	nodes, selected, _ := selectedBuilds(conf, &r.filterFlags)
+	tailed := logTailer{Input: selected,
+		Output: make(chan *logLine, 100), conf: conf, include: include,
+		exclude: exclude, interval: r.Interval, finished: r.Finished}
+	printed := logLinePrinter{Input: tailed.Output}
+	errors := pipeline.Wait(globalContext,
+		append(nodes, &tailed, &printed)...)
+	if err := handleErrors(errors); err != nil {
+		return err
+	}
+	if tailed.failed > 0 {
+		return fmt.Errorf("failed to follow %d builds", tailed.failed)
+	}
+	if tailed.followed == 0 && !r.Finished {
+		fmt.Println("no running builds, use --finished to see the output of finished builds")
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+/*
+Package tjob - Terminate Command
+
+Copyright (c) 2014 Ohmu Ltd.
+Licensed under the Apache License, Version 2.0 (see LICENSE)
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ohmu/tjob/config"
+	"github.com/ohmu/tjob/jenkins"
+	"github.com/ohmu/tjob/pipeline"
+	"github.com/ohmu/tjob/tabout"
+	"sync"
+	"time"
+)
+
+// terminating more builds than this requires --confirm
+const terminateConfirmLimit = 10
+
+// stop actions in the order of increasing force, and what to call a build
+// stopped by each of them
+var stopActions = []struct {
+	action string
+	result string
+}{
+	{"stop", "STOPPED"},
+	{"term", "TERMINATED"},
+	{"kill", "KILLED"},
+}
+
+type terminateJobsCmd struct {
+	filterFlags
+	UserConfirmed bool          `long:"confirm" description:"Confirm terminating many builds"`
+	Grace         time.Duration `long:"grace" default:"10s" description:"Time to wait for a build to stop before using more force"`
+}
+
+// runningCollector collects builds that are running or still queued
+type runningCollector struct {
+	pipeline.Node
+	Input   chan *JobStatus
+	running []*JobStatus
+}
+
+func (node *runningCollector) Run() error {
+	for res := range node.Input {
+		if res.err == nil && res.Status.Building {
+			node.running = append(node.running, res)
+		}
+	}
+	return nil
+}
+
+// waitStopped polls the build until it is no longer running
+func waitStopped(ctx context.Context, conf *config.Config, res *JobStatus, grace time.Duration) (bool, error) {
+	jenk, err := getJenkins(conf, res.Runner)
+	if err != nil {
+		return false, err
+	}
+	deadline := time.Now().Add(grace)
+	for {
+		status, err := jenk.QueryJobStatus(ctx, res.JobName,
+			res.BuildNumber, false)
+		if err != nil {
+			return false, err
+		} else if !status.Building {
+			return true, nil
+		} else if time.Now().After(deadline) {
+			return false, nil
+		}
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// terminate stops a build, using more force after each grace period
+func terminate(ctx context.Context, conf *config.Config, res *JobStatus, grace time.Duration) (string, error) {
+	jenk, err := getJenkins(conf, res.Runner)
+	if err != nil {
+		return "", err
+	}
+	if res.IsQueued() {
+		if err := jenk.CancelQueueItem(ctx, res.QueueItem); err != nil {
+			return "", err
+		}
+		return "CANCELLED", nil
+	}
+	for i, stop := range stopActions {
+		err := jenk.StopBuild(ctx, res.JobName, res.BuildNumber,
+			stop.action)
+		if i > 0 && errors.Is(err, jenkins.ErrNotFound) {
+			// only Pipeline builds can be terminated or killed
+			return "", fmt.Errorf("still running after %s, %s is not "+
+				"available for this build", stopActions[i-1].action,
+				stop.action)
+		} else if err != nil {
+			return "", err
+		}
+		stopped, err := waitStopped(ctx, conf, res, grace)
+		if err != nil {
+			return "", err
+		} else if stopped {
+			return stop.result, nil
+		}
+	}
+	return "", fmt.Errorf("still running after %s",
+		stopActions[len(stopActions)-1].action)
+}
+
+func (r *terminateJobsCmd) Execute(args []string) error {
+	conf, err := config.Load(globalFlags.ConfigFile)
+	if err != nil {
+		return err
+	}
+
+	nodes, selected, collected := selectedBuilds(conf, &r.filterFlags)
+	running := runningCollector{Input: selected}
+	errors := pipeline.Wait(globalContext, append(nodes, &running)...)
+	if err := handleErrors(errors); err != nil {
+		if collected.resolved > 0 {
+			// keep the build numbers of resolved builds
+			if saveErr := conf.Save(); saveErr != nil {
+				return saveErr
+			}
+		}
+		return err
+	}
+
+	count := len(running.running)
+	if count == 0 {
+		fmt.Println("no running builds selected")
+		return nil
+	} else if count > terminateConfirmLimit && !r.UserConfirmed {
+		return fmt.Errorf("terminating more than %d builds (%d builds selected) requires --confirm",
+			terminateConfirmLimit, count)
+	}
+
+	results := make([]string, count)
+	wg := sync.WaitGroup{}
+	for i, res := range running.running {
+		wg.Add(1)
+		go func(i int, res *JobStatus) {
+			defer wg.Done()
+			result, err := terminate(globalContext, conf, res, r.Grace)
+			if err != nil {
+				result = "ERROR: " + err.Error()
+			}
+			results[i] = result
+		}(i, res)
+	}
+	wg.Wait()
+
+	output := tabout.New([]string{"RUNNER", "JOB", "BUILD", "QUEUE-ITEM",
+		"RESULT"}, nil)
+	failed := 0
+	cancelled := make(map[*config.Job]bool)
+	for i, res := range running.running {
+		switch results[i] {
+		case "CANCELLED":
+			cancelled[res.Job] = true
+		case "STOPPED", "TERMINATED", "KILLED":
+		default:
+			failed++
+		}
+		output.Write(map[string]string{
+			"RUNNER": res.Runner, "JOB": res.JobName,
+			"BUILD": res.BuildNumber, "QUEUE-ITEM": res.QueueItem,
+			"RESULT": results[i],
+		})
+	}
+	output.Flush()
+
+	if len(cancelled) > 0 || collected.resolved > 0 {
+		// cancelled queue items will never turn into builds
+		for i := len(conf.Jobs) - 1; i >= 0; i-- {
+			if cancelled[conf.Jobs[i]] {
+				conf.Jobs = append(conf.Jobs[:i],
+					conf.Jobs[i+1:]...)
+			}
+		}
+		if err := conf.Save(); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to terminate %d builds", failed)
+	}
+	return nil
+}
@@ -13,14 +13,43 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"time"
+)
+
+// Build start methods
+const (
+	StartHTTP = "http" // Jenkins REST API, the default
+	StartSSH  = "ssh"  // Jenkins SSH CLI
 )
 
 type Runner struct {
 	URL string
 	sshcmd.SSHPort
-	SSHKey   string
-	User     string
-	Insecure bool
+	SSHKey      string
+	User        string
+	Insecure    bool
+	StartMethod string
+	APIUser     string `json:",omitempty"` // defaults to User
+	APIToken    string `json:",omitempty"`
+	// APITokenFile is read on every run, relative paths are relative
+	// to the config directory
+	APITokenFile string `json:",omitempty"`
+	// HTTP timeouts and retries, zero values use the client defaults
+	ConnectTimeout time.Duration `json:",omitempty"`
+	ReadTimeout    time.Duration `json:",omitempty"`
+	Timeout        time.Duration `json:",omitempty"`
+	Retries        *int          `json:",omitempty"`
+	// TLS files in PEM format, relative paths are relative to the config
+	// directory
+	CACert     string `json:",omitempty"`
+	ClientCert string `json:",omitempty"`
+	ClientKey  string `json:",omitempty"`
+	// Proxy overrides the HTTP(S)_PROXY environment, NoProxy ignores it
+	Proxy   string `json:",omitempty"`
+	NoProxy bool   `json:",omitempty"`
+	// request limits, zero values use the client defaults
+	MaxConcurrency    int     `json:",omitempty"`
+	RequestsPerSecond float64 `json:",omitempty"`
 }
 
 type Project struct {
@@ -32,6 +61,12 @@ type Job struct {
 	BuildNumber string
 	Options     map[string]string
 	Tags        []string
+	QueueItem   string `json:",omitempty"` // set while waiting in the queue
+}
+
+// IsQueued tells if the build is still waiting for a build number
+func (j *Job) IsQueued() bool {
+	return j.BuildNumber == "" && j.QueueItem != ""
 }
 
 func (j *Job) Copy(options map[string]string, tags []string) *Job {
@@ -57,7 +92,8 @@ func (j *Job) Copy(options map[string]string, tags []string) *Job {
 	for i, v := range tagSource {
 		newTags[i] = v // only new tags are set for the new job
 	}
-	return &Job{j.Runner, j.JobName, j.BuildNumber, newOpts, newTags}
+	return &Job{Runner: j.Runner, JobName: j.JobName,
+		BuildNumber: j.BuildNumber, Options: newOpts, Tags: newTags}
 }
 
 type Config struct {
@@ -71,6 +107,9 @@ func (c *Config) Dir() string {
 	return path.Dir(c.path)
 }
 
+// configMode is the mode of the config file
+const configMode = 0600
+
 func Load(filePath string) (*Config, error) {
 	data, err := ioutil.ReadFile(filePath)
 	var config Config
@@ -84,6 +123,12 @@ func Load(filePath string) (*Config, error) {
 		if err != nil {
 			return nil, err
 		}
+		// files saved by older versions were readable by everyone,
+		// the next Save tightens the mode if this fails
+		if info, err := os.Stat(filePath); err == nil &&
+			info.Mode().Perm()&^configMode != 0 {
+			os.Chmod(filePath, configMode)
+		}
 	}
 	config.path = filePath
 
@@ -108,10 +153,14 @@ func (c *Config) Save() error {
 	if err != nil {
 		return err
 	}
+	// only readable by the user, runners may have API tokens
 	tmpPath := c.path + ".tmp"
-	if err = ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+	if err = ioutil.WriteFile(tmpPath, data, configMode); err != nil {
 		return err
 	}
+	if err = os.Chmod(tmpPath, configMode); err != nil {
+		return err // a leftover temp file keeps its mode
+	}
 	if err = os.Rename(tmpPath, c.path); err != nil {
 		return err
 	}
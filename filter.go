@@ -10,17 +10,18 @@ Licensed under the Apache License, Version 2.0 (see LICENSE)
 import (
 	"github.com/ohmu/tjob/config"
 	"github.com/ohmu/tjob/pipeline"
+	"path"
 	"path/filepath"
 	"strings"
 )
 
 type filterFlags struct {
 	FilterTags    []string          `short:"t" long:"tag" description:"Select only builds with tag"`
-	FilterOptions map[string]string `short:"o" long:"option" description:"Select only builds with option key:value"`
+	FilterOptions map[string]string `short:"o" long:"option" description:"Select only builds with option or build parameter key:value"`
 	FilterRunner  []string          `short:"r" long:"runner" description:"Select only builds for the given runner"`
-	FilterJob     []string          `short:"j" long:"job" description:"Select only builds for the given job"`
+	FilterJob     []string          `short:"j" long:"job" description:"Select only builds for the given job, or folder path like team/project/master"`
 	FilterBuild   []string          `short:"b" long:"build" description:"Select only builds with buildnumber"`
-	FilterCommit  string            `short:"m" long:"commit" description:"Select only build with certain commit"`
+	FilterCommit  string            `short:"m" long:"commit" description:"Select only builds with certain commit in any repository"`
 	OnlyAllFailed bool              `long:"all-failed" description:"Select only failed builds"`
 	OnlyFailing   bool              `long:"failing" description:"Select only currently failing builds"`
 }
@@ -57,13 +58,40 @@ func filterByTags(r *filterFlags, job *config.Job) (bool, error) {
 	return true, nil
 }
 
-func filterByOptions(r *filterFlags, job *config.Job) (bool, error) {
+// filterByStoredOptions drops the builds whose options given at start do
+// not match before their status is queried. A build is dropped only when
+// all the wanted options are stored and none of them match, an option
+// without a stored value may still be a Jenkins build parameter, those are
+// checked with filterByOptions after the query.
+func filterByStoredOptions(r *filterFlags, job *config.Job) (bool, error) {
+	if len(r.FilterOptions) == 0 {
+		return true, nil
+	}
+	pass := false
+	for wantKey, wantValue := range r.FilterOptions {
+		value, exists := job.Options[wantKey]
+		if !exists {
+			pass = true
+			continue
+		}
+		matched, err := filepath.Match(wantValue, value)
+		if err != nil {
+			return false, err
+		}
+		pass = pass || matched
+	}
+	return pass, nil
+}
+
+// filterByOptions needs the build parameters from Jenkins, it is applied
+// after the job status query
+func filterByOptions(r *filterFlags, options map[string]string) (bool, error) {
 	if len(r.FilterOptions) == 0 {
 		return true, nil
 	}
 	for wantKey, wantValue := range r.FilterOptions {
 		// TODO: should matching be any or all?
-		matched, err := filepath.Match(wantValue, job.Options[wantKey])
+		matched, err := filepath.Match(wantValue, options[wantKey])
 		if err != nil {
 			return false, err
 		}
@@ -90,8 +118,14 @@ func listFilter(req []string, name string) (bool, error) {
 	return false, nil
 }
 
+// filterByJobName matches either the full path of the job or just its
+// own name, "-j master" selects "team/project/master"
 func filterByJobName(r *filterFlags, job *config.Job) (bool, error) {
-	return listFilter(r.FilterJob, job.JobName)
+	matched, err := listFilter(r.FilterJob, job.JobName)
+	if err != nil || matched {
+		return matched, err
+	}
+	return listFilter(r.FilterJob, path.Base(job.JobName))
 }
 
 func filterByBuildNumber(r *filterFlags, job *config.Job) (bool, error) {
@@ -123,7 +157,7 @@ func (node *jobFilterer) Run() error {
 	defer close(node.Output)
 	for job := range node.Input {
 		matched, err := multiFilter(node.flags, job, filterByTags,
-			filterByOptions, filterByJobName, filterByBuildNumber,
+			filterByStoredOptions, filterByJobName, filterByBuildNumber,
 			filterByRunnerName)
 		if err != nil {
 			return node.AbortWithError(err)
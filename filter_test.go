@@ -0,0 +1,45 @@
+package main
+
+import (
+	"github.com/ohmu/tjob/config"
+	"testing"
+)
+
+func TestFilterByStoredOptions(t *testing.T) {
+	filter := map[string]string{"branch": "release-*", "env": "prod"}
+	cases := []struct {
+		options map[string]string
+		pass    bool
+	}{
+		{nil, true},
+		{map[string]string{"branch": "release-1"}, true},
+		{map[string]string{"branch": "master"}, true},
+		{map[string]string{"env": "test"}, true},
+		{map[string]string{"branch": "master", "env": "prod"}, true},
+		{map[string]string{"branch": "release-2", "env": "test"}, true},
+		{map[string]string{"branch": "master", "env": "test"}, false},
+		{map[string]string{"branch": "master", "env": "test", "x": "1"},
+			false},
+	}
+	flags := filterFlags{FilterOptions: filter}
+	// the filter is a map, repeat to go through it in different orders
+	for i := 0; i < 20; i++ {
+		for _, c := range cases {
+			pass, err := filterByStoredOptions(&flags,
+				&config.Job{Options: c.options})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pass != c.pass {
+				t.Fatalf("options %v: got %v, expected %v", c.options,
+					pass, c.pass)
+			}
+		}
+	}
+
+	pass, err := filterByStoredOptions(&filterFlags{},
+		&config.Job{Options: map[string]string{"env": "test"}})
+	if err != nil || !pass {
+		t.Errorf("no filter: got %v, %v, expected true", pass, err)
+	}
+}
@@ -7,77 +7,254 @@ Licensed under the Apache License, Version 2.0 (see LICENSE)
 package jenkins
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
-	"runtime"
+	"strings"
+	"sync"
+	"time"
 )
 
-var globalCacheLimiter chan struct{}
+// storeFile is the name of the build store in the cache directory
+const storeFile = "builds.db"
 
-func init() {
-	// limit the number of concurrent cache io ops
-	// TODO: better value for the limit
-	globalCacheLimiter = make(chan struct{}, runtime.NumCPU()*2)
+// CacheSchema is the version of the cached JobStatus format, bump it when
+// the fields of JobStatus change and the cached builds are fetched again
+const CacheSchema = 1
+
+// TestReportGrace is how long after a build has finished its test report
+// may still be published, builds cached without one before that are
+// fetched again once it has passed
+var TestReportGrace = 10 * time.Minute
+
+// cacheRecord is the format of the cached builds, the builds of other
+// schema versions are ignored
+type cacheRecord struct {
+	Schema int
+	Status *JobStatus
+}
+
+// CacheEntry describes a cached build
+type CacheEntry struct {
+	Runner  string
+	Job     string
+	Build   string
+	Size    int64
+	Fetched time.Time
 }
 
+// JobCache keeps the results of finished builds in a single file store in
+// CacheDir, which is opened on first use
 type JobCache struct {
 	CacheDir string
+	once     sync.Once
+	store    *store
+	err      error
 }
 
-func (c *JobCache) Retrieve(runner, job, build string) (*JobStatus, error) {
-	if c == nil || c.CacheDir == "" {
-		return nil, nil
-	}
-	fullPath := path.Join(c.CacheDir, runner, job, build+".json")
+func cacheKey(runner, job, build string) string {
+	return runner + "\x00" + job + "\x00" + build
+}
 
-	globalCacheLimiter <- struct{}{}
-	defer func() {
-		<-globalCacheLimiter
-	}()
+func (c *JobCache) open() (*store, error) {
+	c.once.Do(func() {
+		if c.err = os.MkdirAll(c.CacheDir, 0755); c.err != nil {
+			return
+		}
+		c.store, c.err = openStore(path.Join(c.CacheDir, storeFile))
+		if c.err == nil {
+			c.err = c.migrate()
+		}
+	})
+	return c.store, c.err
+}
 
-	data, err := ioutil.ReadFile(fullPath)
+// migrate moves the builds of the old file per build cache to the store.
+// The builds that decode as the current JobStatus are stored with the
+// current schema, the others are kept for the cache commands until fetched
+// again.
+func (c *JobCache) migrate() error {
+	legacy := &fileCache{CacheDir: c.CacheDir}
+	entries, err := legacy.Entries()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		data, err := ioutil.ReadFile(path.Join(c.CacheDir, entry.Runner,
+			entry.Job, entry.Build+".json"))
+		if err != nil {
+			return err
+		}
+		if data = migratedRecord(data); data != nil {
+			err = c.store.Put(cacheKey(entry.Runner, entry.Job,
+				entry.Build), data, entry.Fetched.UnixNano())
+			if err != nil {
+				return err
+			}
+		} // else: a broken file, the build is simply fetched again
+		err = legacy.Remove(entry.Runner, entry.Job, entry.Build)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migratedRecord converts a build of the file per build cache to a cache
+// record, or compacts it as it was when it has fields JobStatus no longer
+// has. It returns nil for a file that is not valid JSON.
+func migratedRecord(data []byte) []byte {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
 	var status JobStatus
-	switch {
-	case os.IsNotExist(err):
+	if decoder.Decode(&status) == nil {
+		if record, err := json.Marshal(cacheRecord{CacheSchema,
+			&status}); err == nil {
+			return record
+		}
+	}
+	var compacted bytes.Buffer
+	if json.Compact(&compacted, data) != nil {
+		return nil
+	}
+	return compacted.Bytes()
+}
+
+func (c *JobCache) Retrieve(runner, job, build string) (*JobStatus, error) {
+	if c == nil || c.CacheDir == "" {
 		return nil, nil
-	case err != nil:
+	}
+	s, err := c.open()
+	if err != nil {
 		return nil, err
-	default:
-		err = json.Unmarshal(data, &status)
-		if err != nil {
-			return nil, err
-		}
-		return &status, nil
 	}
+	data, fetched, err := s.Get(cacheKey(runner, job, build))
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var record cacheRecord
+	if err = json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+	if record.Schema != CacheSchema || record.Status == nil ||
+		record.Status.awaitsTestReport(time.Unix(0, fetched)) {
+		return nil, nil
+	}
+	return record.Status, nil
+}
+
+// awaitsTestReport tells whether a build fetched without a test report
+// should be fetched again, in case the report was published afterwards
+func (j *JobStatus) awaitsTestReport(fetched time.Time) bool {
+	if j.TestReport != nil {
+		return false
+	}
+	deadline := time.UnixMilli(int64(j.Timestamp) + int64(j.Duration)).
+		Add(TestReportGrace)
+	return fetched.Before(deadline) && time.Now().After(deadline)
 }
 
 func (c *JobCache) Store(runner, job, build string, status *JobStatus) error {
 	if c == nil || c.CacheDir == "" || status.Building {
 		return nil
 	}
-	globalCacheLimiter <- struct{}{}
-	defer func() {
-		<-globalCacheLimiter
-	}()
-
-	fullDir := path.Join(c.CacheDir, runner, job)
-	if err := os.MkdirAll(fullDir, 0755); err != nil {
+	s, err := c.open()
+	if err != nil {
 		return err
 	}
-	data, err := json.MarshalIndent(status, "", "\t")
+	data, err := json.Marshal(cacheRecord{CacheSchema, status})
 	if err != nil {
 		return err
 	}
-	fullPath := path.Join(fullDir, build+".json")
-	tmpPath := fullPath + ".tmp"
-	if err = ioutil.WriteFile(tmpPath, data, 0644); err != nil {
-		return err
+	return s.Put(cacheKey(runner, job, build), data, time.Now().UnixNano())
+}
+
+// Entries lists all the cached builds
+func (c *JobCache) Entries() ([]CacheEntry, error) {
+	if c == nil || c.CacheDir == "" {
+		return nil, nil
+	}
+	s, err := c.open()
+	if err != nil {
+		return nil, err
 	}
-	if err = os.Rename(tmpPath, fullPath); err != nil {
+	var entries []CacheEntry
+	s.Keys(func(key string, size int64, fetched int64) {
+		parts := strings.SplitN(key, "\x00", 3)
+		if len(parts) != 3 {
+			return
+		}
+		entries = append(entries, CacheEntry{Runner: parts[0],
+			Job: parts[1], Build: parts[2], Size: size,
+			Fetched: time.Unix(0, fetched)})
+	})
+	return entries, nil
+}
+
+// Remove evicts a cached build, the space is reclaimed by Compact
+func (c *JobCache) Remove(runner, job, build string) error {
+	if c == nil || c.CacheDir == "" {
+		return nil
+	}
+	s, err := c.open()
+	if err != nil {
 		return err
 	}
+	return s.Put(cacheKey(runner, job, build), nil, time.Now().UnixNano())
+}
 
-	return nil
+// Export returns a cached build as stored along with its fetch time, nil
+// when the build is not cached
+func (c *JobCache) Export(runner, job, build string) ([]byte, time.Time, error) {
+	if c == nil || c.CacheDir == "" {
+		return nil, time.Time{}, nil
+	}
+	s, err := c.open()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	data, fetched, err := s.Get(cacheKey(runner, job, build))
+	if err != nil || data == nil {
+		return nil, time.Time{}, err
+	}
+	return data, time.Unix(0, fetched), nil
+}
+
+// Import stores a build exported from another cache unless the build has
+// been fetched later than that, and tells whether it was stored
+func (c *JobCache) Import(runner, job, build string, data []byte, fetched time.Time) (bool, error) {
+	if c == nil || c.CacheDir == "" {
+		return false, nil
+	}
+	if !json.Valid(data) {
+		return false, fmt.Errorf("invalid cached build %s %s %s", runner,
+			job, build)
+	}
+	s, err := c.open()
+	if err != nil {
+		return false, err
+	}
+	key := cacheKey(runner, job, build)
+	local, localFetched, err := s.Get(key)
+	if err != nil {
+		return false, err
+	} else if local != nil && localFetched >= fetched.UnixNano() {
+		return false, nil
+	}
+	return true, s.Put(key, data, fetched.UnixNano())
+}
+
+// Compact rewrites the store without the replaced and removed builds
+func (c *JobCache) Compact() error {
+	if c == nil || c.CacheDir == "" {
+		return nil
+	}
+	s, err := c.open()
+	if err != nil {
+		return err
+	}
+	return s.Compact()
 }
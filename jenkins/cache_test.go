@@ -0,0 +1,390 @@
+package jenkins
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testURL(n int) string {
+	return fmt.Sprintf("https://jenkins.example.com/job/job/%d/", n)
+}
+
+func testStatus(n int) *JobStatus {
+	status := &JobStatus{Result: "SUCCESS", URL: testURL(n),
+		Timestamp: Timestamp(time.Now().UnixMilli()), Duration: 60000}
+	for i := 0; i < 10; i++ {
+		status.Stages = append(status.Stages, Stage{
+			ID: strconv.Itoa(i), Name: fmt.Sprintf("stage %d", i),
+			Status: "SUCCESS", DurationMillis: 1000})
+	}
+	return status
+}
+
+func TestStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	cache := &JobCache{CacheDir: dir}
+	for i := 1; i <= 3; i++ {
+		err := cache.Store("test", "team/job", strconv.Itoa(i), testStatus(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cache.Store("test", "team/job", "2", testStatus(20)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Remove("test", "team/job", "3"); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := &JobCache{CacheDir: dir}
+	for build, number := range map[string]int{"1": 1, "2": 20, "3": 0} {
+		status, err := reopened.Retrieve("test", "team/job", build)
+		switch {
+		case err != nil:
+			t.Fatal(err)
+		case number == 0 && status != nil:
+			t.Errorf("build %s was not removed", build)
+		case number != 0 && (status == nil || status.URL != testURL(number)):
+			t.Errorf("build %s: got %+v, expected number %d", build,
+				status, number)
+		}
+	}
+	entries, err := reopened.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Runner != "test" ||
+		entries[0].Job != "team/job" {
+		t.Errorf("unexpected entries: %+v", entries)
+	}
+}
+
+func TestStoreCompact(t *testing.T) {
+	cache := &JobCache{CacheDir: t.TempDir()}
+	for i := 0; i < 10; i++ {
+		if err := cache.Store("test", "job", "1", testStatus(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cache.Store("test", "job", "2", testStatus(2)); err != nil {
+		t.Fatal(err)
+	}
+	storePath := filepath.Join(cache.CacheDir, storeFile)
+	before, _ := os.Stat(storePath)
+	if err := cache.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := os.Stat(storePath)
+	if after.Size() >= before.Size()/2 {
+		t.Errorf("store size %d after compacting, was %d", after.Size(),
+			before.Size())
+	}
+	status, err := cache.Retrieve("test", "job", "1")
+	if err != nil || status == nil || status.URL != testURL(9) {
+		t.Errorf("got %+v, %v after compacting", status, err)
+	}
+	if err := cache.Store("test", "job", "3", testStatus(3)); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := (&JobCache{CacheDir: cache.CacheDir}).Entries()
+	if err != nil || len(entries) != 3 {
+		t.Errorf("got %d entries, %v after compacting", len(entries), err)
+	}
+}
+
+func TestStoreSharedCompact(t *testing.T) {
+	storePath := filepath.Join(t.TempDir(), storeFile)
+	// two stores on the same file act like two processes
+	first, err := openStore(storePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := openStore(storePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	for key, s := range map[string]*store{"a": first, "b": second} {
+		if err := s.Put(key, []byte(key), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := first.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	// appended to the compacted file, not to the replaced one
+	if err := second.Put("c", []byte("c"), 1); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := openStore(storePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		value, _, err := reopened.Get(key)
+		if err != nil || string(value) != key {
+			t.Errorf("key %s: got %q, %v", key, value, err)
+		}
+	}
+}
+
+func TestStoreTruncatedTail(t *testing.T) {
+	dir := t.TempDir()
+	cache := &JobCache{CacheDir: dir}
+	for i := 1; i <= 2; i++ {
+		err := cache.Store("test", "job", strconv.Itoa(i), testStatus(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	storePath := filepath.Join(dir, storeFile)
+	info, _ := os.Stat(storePath)
+	if err := os.Truncate(storePath, info.Size()-10); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := &JobCache{CacheDir: dir}
+	if status, err := reopened.Retrieve("test", "job", "2"); err != nil ||
+		status != nil {
+		t.Errorf("got %+v, %v for a truncated build", status, err)
+	}
+	if err := reopened.Store("test", "job", "3", testStatus(3)); err != nil {
+		t.Fatal(err)
+	}
+	reopened = &JobCache{CacheDir: dir}
+	for build, found := range map[string]bool{"1": true, "2": false, "3": true} {
+		status, err := reopened.Retrieve("test", "job", build)
+		if err != nil || (status != nil) != found {
+			t.Errorf("build %s: got %+v, %v", build, status, err)
+		}
+	}
+}
+
+func TestStoreMigrate(t *testing.T) {
+	dir := t.TempDir()
+	legacy := &fileCache{CacheDir: dir}
+	for i := 1; i <= 3; i++ {
+		err := legacy.Store("test", "team/job", strconv.Itoa(i), testStatus(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cache := &JobCache{CacheDir: dir}
+	entries, err := cache.Entries()
+	if err != nil || len(entries) != 3 {
+		t.Errorf("got %d entries, %v after migrating", len(entries), err)
+	}
+	status, err := cache.Retrieve("test", "team/job", "2")
+	if err != nil || status == nil || status.URL != testURL(2) ||
+		len(status.Stages) != 10 {
+		t.Errorf("got %+v, %v for a migrated build", status, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "test")); !os.IsNotExist(err) {
+		t.Errorf("legacy cache files were left behind: %v", err)
+	}
+}
+
+func TestCacheSchema(t *testing.T) {
+	cache := &JobCache{CacheDir: t.TempDir()}
+	dir := filepath.Join(cache.CacheDir, "test", "job")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	legacy := `{"Result":"SUCCESS","LastBuiltRevision":{"SHA1":"abc123"}}`
+	err := os.WriteFile(filepath.Join(dir, "1.json"), []byte(legacy), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cache.Store("test", "job", "2", testStatus(2)); err != nil {
+		t.Fatal(err)
+	}
+	old, _ := json.Marshal(cacheRecord{CacheSchema - 1, testStatus(3)})
+	err = cache.store.Put(cacheKey("test", "job", "3"), old,
+		time.Now().UnixNano())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for build, found := range map[string]bool{"1": false, "2": true, "3": false} {
+		status, err := cache.Retrieve("test", "job", build)
+		if err != nil || (status != nil) != found {
+			t.Errorf("build %s: got %+v, %v", build, status, err)
+		}
+	}
+	// outdated builds are only fetched again, not forgotten
+	if entries, err := cache.Entries(); err != nil || len(entries) != 3 {
+		t.Errorf("got %d entries, %v", len(entries), err)
+	}
+}
+
+func TestCacheAwaitsTestReport(t *testing.T) {
+	finished := time.Now().Add(-time.Hour)
+	status := &JobStatus{Result: "SUCCESS",
+		Timestamp: Timestamp(finished.Add(-time.Minute).UnixMilli()),
+		Duration:  60000}
+	for _, test := range []struct {
+		fetched time.Time
+		report  *TestReport
+		awaits  bool
+	}{
+		{finished, nil, true},
+		{finished.Add(TestReportGrace + time.Second), nil, false},
+		{finished, &TestReport{}, false},
+		{time.Now(), nil, false},
+	} {
+		status.TestReport = test.report
+		if status.awaitsTestReport(test.fetched) != test.awaits {
+			t.Errorf("fetched %s after finishing, report %v: expected %v",
+				test.fetched.Sub(finished), test.report != nil,
+				test.awaits)
+		}
+	}
+	// within the grace period the cached build is still used
+	status.Timestamp = Timestamp(time.Now().Add(-time.Minute).UnixMilli())
+	status.TestReport = nil
+	if status.awaitsTestReport(time.Now()) {
+		t.Error("build fetched again within the grace period")
+	}
+}
+
+func TestCacheImport(t *testing.T) {
+	local, remote := &JobCache{CacheDir: t.TempDir()},
+		&JobCache{CacheDir: t.TempDir()}
+	for _, cache := range []*JobCache{local, remote} {
+		for i := 1; i <= 2; i++ {
+			err := cache.Store("test", "job", strconv.Itoa(i), testStatus(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// build 1 was fetched later locally, build 3 only remotely
+	if err := local.Store("test", "job", "1", testStatus(10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Store("test", "job", "2", testStatus(20)); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Store("test", "job", "3", testStatus(30)); err != nil {
+		t.Fatal(err)
+	}
+	for build, imported := range map[string]bool{"1": false, "2": true, "3": true} {
+		data, fetched, err := remote.Export("test", "job", build)
+		if err != nil || data == nil {
+			t.Fatalf("build %s: got %s, %v", build, data, err)
+		}
+		stored, err := local.Import("test", "job", build, data, fetched)
+		if err != nil || stored != imported {
+			t.Errorf("build %s: imported %v, %v", build, stored, err)
+		}
+	}
+	for build, number := range map[string]int{"1": 10, "2": 20, "3": 30} {
+		status, err := local.Retrieve("test", "job", build)
+		if err != nil || status == nil || status.URL != testURL(number) {
+			t.Errorf("build %s: got %+v, %v, expected number %d", build,
+				status, err, number)
+		}
+	}
+	_, err := local.Import("test", "job", "4", []byte("{"), time.Now())
+	if err == nil {
+		t.Error("invalid build was imported")
+	}
+}
+
+const benchBuilds = 1000
+
+type benchCache interface {
+	Retrieve(runner, job, build string) (*JobStatus, error)
+	Store(runner, job, build string, status *JobStatus) error
+}
+
+// benchCaches returns an empty cache of both the old and the new layout
+func benchCaches(b *testing.B) map[string]benchCache {
+	return map[string]benchCache{
+		"files": &fileCache{CacheDir: b.TempDir()},
+		"store": &JobCache{CacheDir: b.TempDir()},
+	}
+}
+
+func BenchmarkCacheStore(b *testing.B) {
+	status := testStatus(1)
+	for name, cache := range benchCaches(b) {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				err := cache.Store("test", "job",
+					strconv.Itoa(i%benchBuilds), status)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCacheRetrieve(b *testing.B) {
+	status := testStatus(1)
+	for name, cache := range benchCaches(b) {
+		for i := 0; i < benchBuilds; i++ {
+			err := cache.Store("test", "job", strconv.Itoa(i), status)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, err := cache.Retrieve("test", "job",
+					strconv.Itoa(i%benchBuilds))
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkCacheEntries measures opening a cache and listing its builds,
+// which is what every command starts with
+func BenchmarkCacheEntries(b *testing.B) {
+	legacyDir, storeDir := b.TempDir(), b.TempDir()
+	data, _ := json.Marshal(testStatus(1))
+	store, err := openStore(filepath.Join(storeDir, storeFile))
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < benchBuilds; i++ {
+		build := strconv.Itoa(i)
+		if err = store.Put(cacheKey("test", "job", build), data,
+			time.Now().UnixNano()); err != nil {
+			b.Fatal(err)
+		}
+		err = (&fileCache{CacheDir: legacyDir}).Store("test", "job",
+			build, testStatus(1))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	store.Close()
+	b.Run("files", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			entries, err := (&fileCache{CacheDir: legacyDir}).Entries()
+			if err != nil || len(entries) != benchBuilds {
+				b.Fatal(len(entries), err)
+			}
+		}
+	})
+	b.Run("store", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			s, err := openStore(filepath.Join(storeDir, storeFile))
+			if err != nil || len(s.index) != benchBuilds {
+				b.Fatal(err)
+			}
+			s.Close()
+		}
+	})
+}
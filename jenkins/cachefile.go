@@ -0,0 +1,144 @@
+/*
+Package jenkins - File Per Build Cache
+
+Copyright (c) 2014 Ohmu Ltd.
+Licensed under the Apache License, Version 2.0 (see LICENSE)
+*/
+package jenkins
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+var globalCacheLimiter chan struct{}
+
+func init() {
+	// limit the number of concurrent cache io ops
+	// TODO: better value for the limit
+	globalCacheLimiter = make(chan struct{}, runtime.NumCPU()*2)
+}
+
+// fileCache is the old cache layout with one JSON file per build, kept for
+// migrating to the build store
+type fileCache struct {
+	CacheDir string
+}
+
+func (c *fileCache) Retrieve(runner, job, build string) (*JobStatus, error) {
+	if c == nil || c.CacheDir == "" {
+		return nil, nil
+	}
+	fullPath := path.Join(c.CacheDir, runner, job, build+".json")
+
+	globalCacheLimiter <- struct{}{}
+	defer func() {
+		<-globalCacheLimiter
+	}()
+
+	data, err := ioutil.ReadFile(fullPath)
+	var status JobStatus
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	default:
+		err = json.Unmarshal(data, &status)
+		if err != nil {
+			return nil, err
+		}
+		return &status, nil
+	}
+}
+
+func (c *fileCache) Store(runner, job, build string, status *JobStatus) error {
+	if c == nil || c.CacheDir == "" || status.Building {
+		return nil
+	}
+	globalCacheLimiter <- struct{}{}
+	defer func() {
+		<-globalCacheLimiter
+	}()
+
+	fullDir := path.Join(c.CacheDir, runner, job)
+	if err := os.MkdirAll(fullDir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(status, "", "\t")
+	if err != nil {
+		return err
+	}
+	fullPath := path.Join(fullDir, build+".json")
+	tmpPath := fullPath + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, fullPath); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Entries lists all the cached builds
+func (c *fileCache) Entries() ([]CacheEntry, error) {
+	if c == nil || c.CacheDir == "" {
+		return nil, nil
+	}
+	var entries []CacheEntry
+	err := filepath.Walk(c.CacheDir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && file == c.CacheDir {
+				return filepath.SkipDir // nothing cached yet
+			}
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(file, ".json") {
+			return nil
+		}
+		rel, err := filepath.Rel(c.CacheDir, file)
+		if err != nil {
+			return err
+		}
+		// runner/job/build.json, folder jobs have more levels
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		if len(parts) < 3 {
+			return nil
+		}
+		entries = append(entries, CacheEntry{
+			Runner: parts[0],
+			Job:    strings.Join(parts[1:len(parts)-1], "/"),
+			Build: strings.TrimSuffix(parts[len(parts)-1],
+				".json"),
+			Size:    info.Size(),
+			Fetched: info.ModTime(),
+		})
+		return nil
+	})
+	return entries, err
+}
+
+// Remove evicts a cached build, along with the directories that are left
+// empty
+func (c *fileCache) Remove(runner, job, build string) error {
+	if c == nil || c.CacheDir == "" {
+		return nil
+	}
+	jobDir := path.Join(c.CacheDir, runner, job)
+	err := os.Remove(path.Join(jobDir, build+".json"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// removing a directory fails when other builds remain
+	cacheDir := path.Clean(c.CacheDir)
+	for dir := jobDir; dir != cacheDir && os.Remove(dir) == nil; {
+		dir = path.Dir(dir)
+	}
+	return nil
+}
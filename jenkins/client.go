@@ -0,0 +1,404 @@
+/*
+Package jenkins - HTTP Client
+
+Copyright (c) 2014 Ohmu Ltd.
+Licensed under the Apache License, Version 2.0 (see LICENSE)
+*/
+package jenkins
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultConnectTimeout = 10 * time.Second
+	DefaultReadTimeout    = time.Minute
+	DefaultTimeout        = 5 * time.Minute
+	DefaultRetries        = 3
+	DefaultMaxConcurrency = 10 // parallel requests per Jenkins instance
+)
+
+// retryBaseDelay is the backoff delay before the first retry, doubled for
+// each following retry
+var retryBaseDelay = 500 * time.Millisecond
+
+// Error categories of unsuccessful HTTP responses, use errors.Is to match
+// them against the returned *HTTPError
+var (
+	ErrNotFound     = errors.New("not found")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrServer       = errors.New("server error")
+)
+
+// ErrOffline is returned for all requests of an offline Jenkins client
+var ErrOffline = errors.New("not available offline")
+
+// HTTPError is returned for responses with a 4xx or 5xx status code
+type HTTPError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+	Err        error  // error category, nil for uncategorized statuses
+	Body       string // start of the error page, Jenkins explains 400s there
+}
+
+// maxErrorBody is the part of an error response body kept in HTTPError
+const maxErrorBody = 4096
+
+func newHTTPError(req *http.Request, resp *http.Response, body []byte) *HTTPError {
+	var category error
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		category = ErrNotFound
+	case resp.StatusCode == http.StatusUnauthorized ||
+		resp.StatusCode == http.StatusForbidden:
+		category = ErrUnauthorized
+	case resp.StatusCode >= 500:
+		category = ErrServer
+	}
+	if len(body) > maxErrorBody {
+		body = body[:maxErrorBody]
+	}
+	return &HTTPError{Method: req.Method, URL: req.URL.String(),
+		StatusCode: resp.StatusCode, Status: resp.Status, Err: category,
+		Body: string(body)}
+}
+
+func (e *HTTPError) Error() string {
+	msg := fmt.Sprintf("%s %s: %s", e.Method, e.URL, e.Status)
+	if e.Err == ErrUnauthorized {
+		msg += ", check the runner user and API token"
+	}
+	return msg
+}
+
+func (e *HTTPError) Unwrap() error {
+	return e.Err
+}
+
+type crumb struct {
+	Crumb             string
+	CrumbRequestField string
+}
+
+// httpClient returns the long-lived client of this Jenkins instance, all
+// requests share its pool of keep-alive connections
+func (j *Jenkins) httpClient() (*http.Client, error) {
+	j.clientOnce.Do(func() {
+		tlsConfig, err := j.tlsConfig()
+		if err != nil {
+			j.clientErr = err
+			return
+		}
+		proxy, err := j.proxy()
+		if err != nil {
+			j.clientErr = err
+			return
+		}
+		dialer := &net.Dialer{
+			Timeout:   j.ConnectTimeout,
+			KeepAlive: 30 * time.Second,
+		}
+		tr := &http.Transport{
+			Proxy:                 proxy,
+			Dial:                  dialer.Dial,
+			TLSClientConfig:       tlsConfig,
+			TLSHandshakeTimeout:   j.ConnectTimeout,
+			ResponseHeaderTimeout: j.ReadTimeout,
+			MaxIdleConnsPerHost:   cap(j.limiter().slots),
+			IdleConnTimeout:       90 * time.Second,
+		}
+		j.client = &http.Client{Transport: tr, Jar: j.jar,
+			Timeout: j.Timeout}
+	})
+	return j.client, j.clientErr
+}
+
+func (j *Jenkins) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: j.InsecureSkipVerify}
+	if j.CACertFile != "" {
+		pem, err := ioutil.ReadFile(j.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %s", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool() // e.g. no system pool on windows
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in '%s'",
+				j.CACertFile)
+		}
+		config.RootCAs = pool
+	}
+	if j.ClientCertFile != "" || j.ClientKeyFile != "" {
+		if j.ClientCertFile == "" || j.ClientKeyFile == "" {
+			return nil, fmt.Errorf(
+				"both a client certificate and a key are required")
+		}
+		cert, err := tls.LoadX509KeyPair(j.ClientCertFile,
+			j.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"failed to load client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func (j *Jenkins) proxy() (func(*http.Request) (*url.URL, error), error) {
+	switch {
+	case j.NoProxy:
+		return nil, nil
+	case j.Proxy != "":
+		proxyURL, err := ParseProxy(j.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		return http.ProxyURL(proxyURL), nil
+	}
+	return http.ProxyFromEnvironment, nil
+}
+
+// ParseProxy validates a proxy URL, e.g. "http://proxy.example.com:3128"
+func ParseProxy(proxy string) (*url.URL, error) {
+	proxyURL, err := url.Parse(proxy)
+	if err != nil || proxyURL.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL '%s'", proxy)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+		return proxyURL, nil
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme in '%s'", proxy)
+}
+
+// isRetryable tells if a failed idempotent request is worth another try
+func isRetryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return errors.Is(err, syscall.ECONNRESET) ||
+			errors.Is(err, io.EOF) ||
+			errors.Is(err, io.ErrUnexpectedEOF)
+	}
+	return resp.StatusCode >= 500
+}
+
+// backoff returns a jittered exponential delay for the given retry
+func backoff(retry int) time.Duration {
+	delay := retryBaseDelay << uint(retry)
+	return delay/2 + time.Duration(rand.Int63n(int64(delay)))
+}
+
+// do sends an authenticated request and returns the response with its
+// body fully read. GET requests are retried on server errors and dropped
+// connections. Unsuccessful responses are returned along with an
+// *HTTPError.
+func (j *Jenkins) do(req *http.Request) (*http.Response, []byte, error) {
+	if j.APIToken != "" {
+		req.SetBasicAuth(j.User, j.APIToken)
+	}
+	attempts := 1
+	if req.Method == "GET" || req.Method == "HEAD" {
+		attempts += j.Retries
+	}
+	var resp *http.Response
+	var body []byte
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-req.Context().Done():
+				return nil, nil, req.Context().Err()
+			case <-time.After(backoff(attempt - 1)):
+			}
+		}
+		resp, body, err = j.send(req)
+		if !isRetryable(resp, err) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode >= 400 {
+		return resp, body, newHTTPError(req, resp, body)
+	}
+	return resp, body, nil
+}
+
+// send makes a single attempt at a request
+func (j *Jenkins) send(req *http.Request) (*http.Response, []byte, error) {
+	if j.Offline {
+		return nil, nil, ErrOffline
+	}
+	client, err := j.httpClient()
+	if err != nil {
+		return nil, nil, err
+	}
+	limiter := j.limiter()
+	if err := limiter.acquire(req.Context()); err != nil {
+		return nil, nil, err
+	}
+	defer limiter.release()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, body, nil
+}
+
+// limitedBody releases the request limiter slot of a streamed response
+type limitedBody struct {
+	io.ReadCloser
+	limiter *requestLimiter
+	once    sync.Once
+}
+
+func (b *limitedBody) Close() error {
+	b.once.Do(b.limiter.release)
+	return b.ReadCloser.Close()
+}
+
+// open sends an authenticated request and returns the response with its
+// body unread, for downloads too large to keep in memory. The request is
+// not subject to the total request timeout, and it holds a request limiter
+// slot until the body is closed.
+func (j *Jenkins) open(req *http.Request) (*http.Response, error) {
+	if j.Offline {
+		return nil, ErrOffline
+	}
+	if j.APIToken != "" {
+		req.SetBasicAuth(j.User, j.APIToken)
+	}
+	shared, err := j.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	client := *shared
+	client.Timeout = 0
+	limiter := j.limiter()
+	if err := limiter.acquire(req.Context()); err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		limiter.release()
+		return nil, err
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, limiter: limiter}
+	if resp.StatusCode >= 400 {
+		resp.Body.Close()
+		return nil, newHTTPError(req, resp, nil)
+	}
+	return resp, nil
+}
+
+// get fetches a path relative to the Jenkins URL
+func (j *Jenkins) get(ctx context.Context, sub string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", j.URL+"/"+sub, nil)
+	if err != nil {
+		return nil, err
+	}
+	_, body, err := j.do(req)
+	return body, err
+}
+
+func (j *Jenkins) jsonRequest(ctx context.Context,
+	jobName string, sub string, params string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET",
+		fmt.Sprintf("%s/%s/%s/api/json%s", j.URL, jobName, sub, params),
+		nil)
+	if err != nil {
+		return nil, err
+	}
+	_, body, err := j.do(req)
+	return body, err
+}
+
+// getCrumb returns the CSRF protection crumb required by state-changing
+// requests, an empty crumb means that the protection is disabled
+func (j *Jenkins) getCrumb(ctx context.Context) (*crumb, error) {
+	j.crumbMutex.Lock()
+	defer j.crumbMutex.Unlock()
+	if j.crumb != nil {
+		return j.crumb, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", j.URL+"/crumbIssuer/api/json", nil)
+	if err != nil {
+		return nil, err
+	}
+	_, body, err := j.do(req)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		j.crumb = &crumb{} // crumb issuer not enabled
+	case err != nil:
+		return nil, err
+	default:
+		var issued crumb
+		if err := decodeJSON(body, &issued); err != nil {
+			return nil, fmt.Errorf("failed to parse crumb: %s", err)
+		}
+		j.crumb = &issued
+	}
+	return j.crumb, nil
+}
+
+func (j *Jenkins) forgetCrumb() {
+	j.crumbMutex.Lock()
+	defer j.crumbMutex.Unlock()
+	j.crumb = nil
+}
+
+// postRequest POSTs form values to a path relative to the Jenkins URL and
+// returns the Location header of the response
+func (j *Jenkins) postRequest(ctx context.Context, sub string, values url.Values) (string, error) {
+	for retry := true; ; retry = false {
+		crumb, err := j.getCrumb(ctx)
+		if err != nil {
+			return "", err
+		}
+		req, err := http.NewRequestWithContext(ctx, "POST", j.URL+"/"+sub,
+			strings.NewReader(values.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type",
+			"application/x-www-form-urlencoded")
+		if crumb.CrumbRequestField != "" {
+			req.Header.Set(crumb.CrumbRequestField, crumb.Crumb)
+		}
+		resp, _, err := j.do(req)
+		if retry && resp != nil &&
+			resp.StatusCode == http.StatusForbidden &&
+			crumb.CrumbRequestField != "" {
+			// the crumb may have expired with the web session
+			j.forgetCrumb()
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return resp.Header.Get("Location"), nil
+	}
+}
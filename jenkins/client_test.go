@@ -0,0 +1,82 @@
+package jenkins
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryServerErrors(t *testing.T) {
+	defer func(delay time.Duration) { retryBaseDelay = delay }(retryBaseDelay)
+	retryBaseDelay = time.Millisecond
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&attempts, 1) < 3 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			w.Write([]byte(`{"jobs":[]}`))
+		}))
+	defer server.Close()
+	j := MakeJenkins("test", server.URL, false, nil)
+	if _, err := j.jsonRequest(context.Background(), "view/All", "",
+		""); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 3 {
+		t.Errorf("got %d attempts, expected 3", attempts)
+	}
+
+	atomic.StoreInt32(&attempts, -10)
+	j.Retries = 2
+	_, err := j.jsonRequest(context.Background(), "view/All", "", "")
+	if !errors.Is(err, ErrServer) || attempts != -7 {
+		t.Errorf("got %v after %d attempts, expected %v after 3", err,
+			attempts+10, ErrServer)
+	}
+}
+
+func TestNoRetryClientErrors(t *testing.T) {
+	defer func(delay time.Duration) { retryBaseDelay = delay }(retryBaseDelay)
+	retryBaseDelay = time.Millisecond
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&attempts, 1)
+			switch {
+			case strings.HasPrefix(r.URL.Path, "/locked/"):
+				w.WriteHeader(http.StatusUnauthorized)
+			case r.URL.Path == "/job/x/build":
+				w.WriteHeader(http.StatusServiceUnavailable)
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	defer server.Close()
+	j := MakeJenkins("test", server.URL, false, nil)
+	for path, expected := range map[string]error{"missing": ErrNotFound,
+		"locked": ErrUnauthorized} {
+		atomic.StoreInt32(&attempts, 0)
+		_, err := j.jsonRequest(context.Background(), path, "", "")
+		if !errors.Is(err, expected) || attempts != 1 {
+			t.Errorf("%s: got %v after %d attempts, expected %v after 1",
+				path, err, attempts, expected)
+		}
+	}
+
+	// state-changing requests are never repeated
+	atomic.StoreInt32(&attempts, 0)
+	_, err := j.postRequest(context.Background(), "job/x/build",
+		url.Values{})
+	if !errors.Is(err, ErrServer) || attempts != 2 { // crumb and POST
+		t.Errorf("got %v after %d attempts, expected %v after 2", err,
+			attempts, ErrServer)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !unix
+
+/*
+Package jenkins - Build Store File Locks
+
+Copyright (c) 2014 Ohmu Ltd.
+Licensed under the Apache License, Version 2.0 (see LICENSE)
+*/
+package jenkins
+
+import "os"
+
+// lockFile does nothing without flock, the build store is then only safe
+// to use from one process at a time
+func lockFile(file *os.File, exclusive bool) error {
+	return nil
+}
+
+func unlockFile(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,33 @@
+//go:build unix
+
+/*
+Package jenkins - Build Store File Locks
+
+Copyright (c) 2014 Ohmu Ltd.
+Licensed under the Apache License, Version 2.0 (see LICENSE)
+*/
+package jenkins
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an advisory lock on a file, shared or exclusive, waiting
+// for the locks of other processes to be released
+func lockFile(file *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	for {
+		err := syscall.Flock(int(file.Fd()), how)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+func unlockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
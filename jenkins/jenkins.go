@@ -7,122 +7,375 @@ Licensed under the Apache License, Version 2.0 (see LICENSE)
 package jenkins
 
 import (
-	"crypto/tls"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/ohmu/tjob/sshcmd"
-	"io/ioutil"
+	"io"
 	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
-var globalNetworkLimiter chan struct{}
-
-func init() {
-	// limit the number of concurrent network ops
-	// TODO: better value for the limit
-	globalNetworkLimiter = make(chan struct{}, 10)
-}
+var ErrQueueItemCancelled = errors.New("queue item was cancelled")
 
+// Jenkins is a client for one Jenkins instance, the exported settings must
+// be set before the first request is made
 type Jenkins struct {
 	name               string
 	URL                string
 	InsecureSkipVerify bool
+	User               string // HTTP basic auth user for the API token
+	APIToken           string
+	ConnectTimeout     time.Duration // TCP connect and TLS handshake
+	ReadTimeout        time.Duration // waiting for response headers
+	Timeout            time.Duration // whole request including body
+	Retries            int           // extra attempts for failed GETs
+	CACertFile         string        // PEM bundle trusted besides the system CAs
+	ClientCertFile     string        // PEM client certificate for mutual TLS
+	ClientKeyFile      string
+	Proxy              string  // proxy URL, empty uses the environment
+	NoProxy            bool    // connect directly, ignoring the environment
+	MaxConcurrency     int     // parallel requests
+	RequestsPerSecond  float64 // zero for no rate limit
+	Offline            bool    // serve builds only from the JobCache
 	SSH                *sshcmd.SSHNode
 	*JobCache
+	jar         http.CookieJar        // crumbs are tied to the web session
+	summaries   map[string]*JobStatus // "job#build" -> history summary
+	summaryMu   sync.Mutex
+	clientOnce  sync.Once
+	client      *http.Client
+	clientErr   error
+	limiterOnce sync.Once
+	requests    *requestLimiter
+	crumbMutex  sync.Mutex
+	crumb       *crumb // nil until fetched
 }
 
 func MakeJenkins(runnerID, url string, insecure bool, jobCache *JobCache) *Jenkins {
+	jar, _ := cookiejar.New(nil) // never fails without options
 	return &Jenkins{
 		name:               runnerID,
 		URL:                url,
 		InsecureSkipVerify: insecure,
+		ConnectTimeout:     DefaultConnectTimeout,
+		ReadTimeout:        DefaultReadTimeout,
+		Timeout:            DefaultTimeout,
+		Retries:            DefaultRetries,
+		MaxConcurrency:     DefaultMaxConcurrency,
 		JobCache:           jobCache,
+		jar:                jar,
+		summaries:          make(map[string]*JobStatus),
 	}
 }
 
-func (j *Jenkins) jsonRequest(
-	jobName string, sub string, params string) ([]byte, error) {
-	globalNetworkLimiter <- struct{}{}
-	defer func() {
-		<-globalNetworkLimiter
-	}()
-	// TODO: better HTTP transport management, reuse of keep-alive connections
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: bool(j.InsecureSkipVerify),
-		},
+// queuePollInterval is the delay between queue item status queries
+var queuePollInterval = time.Second
+
+// historyPageSize is the number of builds fetched per history request
+var historyPageSize = 100
+
+// summaryTree selects the build fields shown in build listings, test
+// counts come from the test result actions instead of the test report
+const summaryTree = "number,building,duration,builtOn,result,timestamp,url," +
+	"actions[causes[" + causeTree + "],parameters[name,value]," + scmTree +
+	",failCount,skipCount,totalCount]," +
+	"changeSets[kind,items[commitId,author[fullName],msg]]"
+
+// causeTree selects the user and upstream build that started a build
+const causeTree = "userId,upstreamProject,upstreamBuild"
+
+// changeSetTree selects the commits of a build, "changeSet" is the old
+// single SCM version of "changeSets"
+const changeSetTree = "changeSets[kind,items[commitId,author[fullName],msg,affectedPaths]]," +
+	"changeSet[kind,items[commitId,author[fullName],msg,affectedPaths]]"
+
+// scmTree selects the Git plugin build data of each checked out repository
+const scmTree = "lastBuiltRevision[SHA1,branch[SHA1,name]],remoteUrls,scmName"
+
+// jobPath returns the URL path of a job, folders and multibranch projects
+// are separated with slashes in job names: "team/project/master"
+func jobPath(jobName string) string {
+	parts := strings.Split(jobName, "/")
+	for i, part := range parts {
+		parts[i] = "job/" + url.PathEscape(part)
 	}
-	defer tr.CloseIdleConnections()
-	client := &http.Client{Transport: tr}
-	url := fmt.Sprintf("%s/%s/%s/api/json%s",
-		j.URL, jobName, sub, params)
-	resp, err := client.Get(url)
+	return strings.Join(parts, "/")
+}
+
+// QueryJobs returns the full names of all jobs, including the ones inside
+// folders and multibranch projects
+func (j *Jenkins) QueryJobs(ctx context.Context) ([]string, error) {
+	return j.queryFolder(ctx, "")
+}
+
+func (j *Jenkins) queryFolder(ctx context.Context, folder string) ([]string, error) {
+	// TODO: send to channel instead of returning slice
+	base, sub := "view", "All"
+	if folder != "" {
+		base, sub = jobPath(folder), ""
+	}
+	// only containers (folders, multibranch projects, organizations)
+	// have the "jobs" property
+	jobsJSON, err := j.jsonRequest(ctx, base, sub, "?tree=jobs[name,jobs[name]]")
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+
+	var jobs Jobs
+	err = decodeJSON(jobsJSON, &jobs)
 	if err != nil {
 		return nil, err
 	}
-	return body, nil
+	if jobs.Jobs == nil {
+		return nil, nil
+	}
+	jobsStr := make([]string, 0, len(*jobs.Jobs))
+	for _, job := range *jobs.Jobs {
+		fullName := job.Name
+		if folder != "" {
+			fullName = folder + "/" + job.Name
+		}
+		if job.Jobs == nil {
+			jobsStr = append(jobsStr, fullName)
+			continue
+		}
+		nested, err := j.queryFolder(ctx, fullName)
+		if err != nil {
+			return nil, err
+		}
+		jobsStr = append(jobsStr, nested...)
+	}
+	return jobsStr, nil
 }
 
-func (j *Jenkins) QueryJobs() ([]string, error) {
+// QueryJobBuilds returns the numbers of all the builds of a job, without
+// fetching anything else
+func (j *Jenkins) QueryJobBuilds(ctx context.Context, jobName string) ([]string, error) {
 	// TODO: send to channel instead of returning slice
-	jobsJSON, err := j.jsonRequest("view", "All", "?tree=jobs[name]")
+	buildsJSON, err := j.jsonRequest(ctx, jobPath(jobName), "",
+		"?tree=allBuilds[number]")
 	if err != nil {
 		return nil, err
 	}
 
-	var jobs Jobs
-	err = json.Unmarshal(jobsJSON, &jobs)
+	var builds struct {
+		AllBuilds []Build
+	}
+	err = decodeJSON(buildsJSON, &builds)
 	if err != nil {
 		return nil, err
 	}
-	jobsStr := make([]string, len(*jobs.Jobs))
-	for i, job := range *jobs.Jobs {
-		jobsStr[i] = job.Name
+	buildStr := make([]string, len(builds.AllBuilds))
+	for i, build := range builds.AllBuilds {
+		buildStr[i] = strconv.Itoa(build.Number)
 	}
-	return jobsStr, nil
+	return buildStr, nil
+}
+
+// QueryJobHistory returns the build numbers of all builds of a job. Build
+// summaries are fetched in pages along with the numbers and remembered for
+// QueryJobStatus calls that don't need test details.
+func (j *Jenkins) QueryJobHistory(ctx context.Context, jobName string) ([]string, error) {
+	return j.queryHistory(ctx, jobName, 0)
 }
 
-func (j *Jenkins) QueryJobBuilds(jobName string) ([]string, error) {
+// queryHistory returns builds newest first, stopping at the first page
+// that reaches builds started before since
+func (j *Jenkins) queryHistory(ctx context.Context, jobName string, since Timestamp) ([]string, error) {
 	// TODO: send to channel instead of returning slice
-	buildsJSON, err := j.jsonRequest("job/"+jobName, "", "?tree=builds[number]")
+	var buildStr []string
+	for from := 0; ; from += historyPageSize {
+		// unlike "builds", "allBuilds" is not capped at 100 builds
+		historyJSON, err := j.jsonRequest(ctx, jobPath(jobName), "",
+			fmt.Sprintf("?tree=allBuilds[%s]{%d,%d}", summaryTree,
+				from, from+historyPageSize))
+		if err != nil {
+			return nil, err
+		}
+		var history JobHistory
+		if err = decodeJSON(historyJSON, &history); err != nil {
+			return nil, err
+		}
+		reachedSince := false
+		j.summaryMu.Lock()
+		for _, build := range history.AllBuilds {
+			buildNumber := strconv.Itoa(build.Number)
+			summary := build.JobStatus
+			summary.Prune()
+			j.summaries[jobName+"#"+buildNumber] = &summary
+			buildStr = append(buildStr, buildNumber)
+			reachedSince = reachedSince || summary.Timestamp < since
+		}
+		j.summaryMu.Unlock()
+		if len(history.AllBuilds) < historyPageSize || reachedSince {
+			return buildStr, nil
+		}
+	}
+}
+
+// QueryDownstreamBuilds returns the builds of the downstream projects of a
+// job that were triggered by the given build
+func (j *Jenkins) QueryDownstreamBuilds(ctx context.Context, jobName, buildNumber string) ([]BuildRef, error) {
+	upstream, err := j.QueryJobStatus(ctx, jobName, buildNumber, false)
 	if err != nil {
 		return nil, err
 	}
+	projectsJSON, err := j.jsonRequest(ctx, jobPath(jobName), "",
+		"?tree=downstreamProjects[fullName]")
+	if err != nil {
+		return nil, err
+	}
+	var projects struct {
+		DownstreamProjects []struct {
+			FullName string
+		}
+	}
+	if err = decodeJSON(projectsJSON, &projects); err != nil {
+		return nil, err
+	}
+	var refs []BuildRef
+	for _, project := range projects.DownstreamProjects {
+		builds, err := j.queryHistory(ctx, project.FullName,
+			upstream.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+		for _, build := range builds {
+			summary := j.historySummary(project.FullName, build)
+			if summary.HasUpstream(jobName, buildNumber) {
+				refs = append(refs, BuildRef{project.FullName, build})
+			}
+		}
+	}
+	return refs, nil
+}
 
-	var builds JobBuilds
-	err = json.Unmarshal(buildsJSON, &builds)
+// QueryPromotions returns the builds of the promotion processes (promoted
+// builds plugin) of a job that were triggered by the given build. Jobs
+// without promotion processes have none.
+func (j *Jenkins) QueryPromotions(ctx context.Context, jobName, buildNumber string) ([]Promotion, error) {
+	upstream, err := j.QueryJobStatus(ctx, jobName, buildNumber, false)
 	if err != nil {
 		return nil, err
 	}
-	buildStr := make([]string, len(*builds.Builds))
-	for i, build := range *builds.Builds {
-		buildStr[i] = strconv.Itoa(build.Number)
+	processesJSON, err := j.jsonRequest(ctx, jobPath(jobName), "promotion",
+		"?tree=processes[name]")
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil // not a promoted job
+	} else if err != nil {
+		return nil, err
 	}
-	return buildStr, nil
+	var processes struct {
+		Processes []struct {
+			Name string
+		}
+	}
+	if err = decodeJSON(processesJSON, &processes); err != nil {
+		return nil, err
+	}
+	var promotions []Promotion
+	for _, process := range processes.Processes {
+		sub := "promotion/process/" + url.PathEscape(process.Name)
+		for from := 0; ; from += historyPageSize {
+			historyJSON, err := j.jsonRequest(ctx, jobPath(jobName), sub,
+				fmt.Sprintf("?tree=allBuilds[%s]{%d,%d}", summaryTree,
+					from, from+historyPageSize))
+			if err != nil {
+				return nil, err
+			}
+			var history JobHistory
+			if err = decodeJSON(historyJSON, &history); err != nil {
+				return nil, err
+			}
+			reachedBuild := false
+			for _, build := range history.AllBuilds {
+				status := build.JobStatus
+				status.Prune()
+				if status.HasUpstream(jobName, buildNumber) {
+					promotions = append(promotions, Promotion{
+						process.Name, strconv.Itoa(build.Number),
+						&status})
+				}
+				// promotions start after the promoted build
+				reachedBuild = reachedBuild ||
+					status.Timestamp < upstream.Timestamp
+			}
+			if len(history.AllBuilds) < historyPageSize || reachedBuild {
+				break
+			}
+		}
+	}
+	return promotions, nil
 }
 
-func (j *Jenkins) QueryJobStatus(jobName string, jobNumber string, testDetails bool) (*JobStatus, error) {
+// BuildDeleted tells whether a build no longer exists. Jenkins answers
+// 404 also for jobs that the user is not allowed to read, so a build only
+// counts as deleted when its job can be read and the build cannot.
+func (j *Jenkins) BuildDeleted(ctx context.Context, jobName, buildNumber string) (bool, error) {
+	_, err := j.jsonRequest(ctx, jobPath(jobName), "", "?tree=name")
+	if errors.Is(err, ErrNotFound) {
+		return false, fmt.Errorf(
+			"job %s is deleted or not readable with the runner credentials",
+			jobName)
+	} else if err != nil {
+		return false, err
+	}
+	_, err = j.jsonRequest(ctx, jobPath(jobName), buildNumber,
+		"?tree=number")
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return true, nil
+	case err != nil:
+		return false, err
+	}
+	return false, nil
+}
+
+func (j *Jenkins) historySummary(jobName, jobNumber string) *JobStatus {
+	j.summaryMu.Lock()
+	defer j.summaryMu.Unlock()
+	return j.summaries[jobName+"#"+jobNumber]
+}
+
+// QueryJobStatus returns the status of a build from the cache, from the
+// summaries fetched by QueryJobHistory when details (test cases, pipeline
+// stages, changeset paths) are not needed, or from Jenkins. Finished builds
+// fetched from Jenkins are cached. Offline, builds that are not cached have
+// the result UNKNOWN.
+func (j *Jenkins) QueryJobStatus(ctx context.Context, jobName string, jobNumber string, details bool) (*JobStatus, error) {
 	cached, err := j.JobCache.Retrieve(j.name, jobName, jobNumber)
 	if err != nil || cached != nil {
 		return cached, err
 	}
-	testDetails = true // always ask for details when using cache
-	mainJSON, err := j.jsonRequest(
-		"job/"+jobName, fmt.Sprintf("/%s", jobNumber),
-		"?tree=building,duration,builtOn,result,timestamp,url,actions[causes[userId]]")
+	if j.Offline {
+		return &JobStatus{Result: "UNKNOWN"}, nil
+	}
+	if !details {
+		if summary := j.historySummary(jobName, jobNumber); summary != nil {
+			return summary, nil
+		}
+	}
+	testDetails := true // always ask for details when using cache
+	mainJSON, err := j.jsonRequest(ctx,
+		jobPath(jobName), fmt.Sprintf("/%s", jobNumber),
+		"?tree=building,duration,builtOn,result,timestamp,url,"+
+			"actions[causes["+causeTree+"],parameters[name,value],"+scmTree+"],"+
+			"artifacts[fileName,relativePath],"+changeSetTree)
 	if err != nil {
 		return nil, err
 	}
 
 	var status JobStatus
-	err = json.Unmarshal(mainJSON, &status)
+	err = decodeJSON(mainJSON, &status)
 	if err != nil {
 		return nil, err
 	}
@@ -145,24 +398,18 @@ func (j *Jenkins) QueryJobStatus(jobName string, jobNumber string, testDetails b
 		*/
 		extra = ",suites[cases[status,name,className,duration,errorStackTrace,stderr,stdout]]"
 	}
-	testReportJSON, err := j.jsonRequest("job/"+jobName,
+	testReportJSON, err := j.jsonRequest(ctx, jobPath(jobName),
 		fmt.Sprintf("/%s/testReport", jobNumber),
 		"?tree=duration,failCount,passCount,skipCount"+extra)
-	if err != nil {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		testReportJSON = nil // no test report published (yet)
+	case err != nil:
 		return nil, err
 	}
 	var testReport TestReport
-	err = json.Unmarshal(testReportJSON, &testReport)
-	if err != nil {
-		// Jenkins may generate invalid JSON:
-		// '{"duration":NaN,"failCount":5,"passCount":4422}'
-		// attempt naive hack and replace NaN with null
-		// NOTE: may screw up other values in the 'JSON' data
-		testReportJSON = []byte(strings.Replace(string(testReportJSON),
-			"\":NaN,", "\":null,", -1))
-		err = json.Unmarshal(testReportJSON, &testReport)
-	}
-	if err == nil {
+	err = decodeJSON(testReportJSON, &testReport)
+	if err == nil && testReportJSON != nil {
 		status.TestReport = &testReport
 	} else {
 		// TODO: no sense to show warning here?
@@ -172,20 +419,11 @@ func (j *Jenkins) QueryJobStatus(jobName string, jobNumber string, testDetails b
 	// Remove uninteresting test results to lose weight
 	status.TestReport.Prune()
 
-	gitStatusJSON, err := j.jsonRequest("job/"+jobName,
-		fmt.Sprintf("/%s/git", jobNumber),
-		"?tree=lastBuiltRevision[branch[SHA1,name]],remoteUrls")
-	if err != nil {
-		// TODO: accept error, Git plugin may not be installed
-		return nil, err
-	}
-	var gitStatus GitStatus
-	err = json.Unmarshal(gitStatusJSON, &gitStatus)
-	if err == nil {
-		status.GitStatus = &gitStatus
-	} else {
-		// TODO: no sense to show warning here?
-		//fmt.Println("WARNING: failed to parse gitStatus:", err)
+	if status.HasStages() {
+		status.Stages, err = j.QueryStages(ctx, jobName, jobNumber)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	status.Prune() // trim off extra weight
@@ -196,3 +434,303 @@ func (j *Jenkins) QueryJobStatus(jobName string, jobNumber string, testDetails b
 
 	return &status, nil // may return nil status.TestReport
 }
+
+// ProgressiveText returns the console output of a build starting from byte
+// offset start, along with the offset of the next chunk and whether the
+// build may still produce more output
+func (j *Jenkins) ProgressiveText(ctx context.Context, jobName, buildNumber string, start int64) ([]byte, int64, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf(
+		"%s/%s/%s/logText/progressiveText?start=%d",
+		j.URL, jobPath(jobName), buildNumber, start), nil)
+	if err != nil {
+		return nil, start, false, err
+	}
+	resp, text, err := j.do(req)
+	if err != nil {
+		return nil, start, false, err
+	}
+	next, err := strconv.ParseInt(resp.Header.Get("X-Text-Size"), 10, 64)
+	if err != nil {
+		next = start + int64(len(text))
+	}
+	more := resp.Header.Get("X-More-Data") == "true"
+	return text, next, more, nil
+}
+
+// StopBuild asks Jenkins to abort a running build. The action is one of
+// "stop", "term" and "kill", in the order of increasing force.
+func (j *Jenkins) StopBuild(ctx context.Context, jobName, buildNumber, action string) error {
+	_, err := j.postRequest(ctx, fmt.Sprintf("%s/%s/%s", jobPath(jobName),
+		buildNumber, action), nil)
+	return err
+}
+
+// CancelQueueItem removes a build that is still waiting in the queue
+func (j *Jenkins) CancelQueueItem(ctx context.Context, queueItem string) error {
+	_, err := j.postRequest(ctx, "queue/cancelItem",
+		url.Values{"id": {queueItem}})
+	return err
+}
+
+// QueryStages returns the stages of a Pipeline build, or nil for other
+// kinds of builds
+func (j *Jenkins) QueryStages(ctx context.Context, jobName, buildNumber string) ([]Stage, error) {
+	describeJSON, err := j.get(ctx, fmt.Sprintf("%s/%s/wfapi/describe",
+		jobPath(jobName), buildNumber))
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return nil, nil // not a Pipeline job, or no stage view plugin
+	case err != nil:
+		return nil, err
+	}
+	var describe struct {
+		Stages []Stage
+	}
+	if err = decodeJSON(describeJSON, &describe); err != nil {
+		return nil, err
+	}
+	return describe.Stages, nil
+}
+
+// QueryArtifacts returns the artifacts archived by a build, always fresh
+// from Jenkins, cached statuses may predate the artifacts
+func (j *Jenkins) QueryArtifacts(ctx context.Context, jobName, buildNumber string) ([]Artifact, error) {
+	artifactsJSON, err := j.jsonRequest(ctx, jobPath(jobName), buildNumber,
+		"?tree=artifacts[fileName,relativePath]")
+	if err != nil {
+		return nil, err
+	}
+	var status JobStatus
+	if err = decodeJSON(artifactsJSON, &status); err != nil {
+		return nil, err
+	}
+	return status.Artifacts, nil
+}
+
+func (j *Jenkins) artifactURL(jobName, buildNumber, relativePath string) string {
+	parts := strings.Split(relativePath, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return fmt.Sprintf("%s/%s/%s/artifact/%s", j.URL, jobPath(jobName),
+		buildNumber, strings.Join(parts, "/"))
+}
+
+// ArtifactSize returns the size of an artifact in bytes
+func (j *Jenkins) ArtifactSize(ctx context.Context, jobName, buildNumber, relativePath string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD",
+		j.artifactURL(jobName, buildNumber, relativePath), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, _, err := j.do(req)
+	if err != nil {
+		return 0, err
+	}
+	return resp.ContentLength, nil
+}
+
+// Artifact download results
+const (
+	Downloaded = "DOWNLOADED"
+	Resumed    = "RESUMED"
+	Skipped    = "SKIPPED" // already downloaded
+)
+
+// DownloadArtifact saves an artifact to a local file. A partial download
+// left behind in "<dest>.part" is resumed, and nothing is downloaded when
+// dest already exists with the right size.
+func (j *Jenkins) DownloadArtifact(ctx context.Context, jobName, buildNumber, relativePath, dest string) (string, error) {
+	size, err := j.ArtifactSize(ctx, jobName, buildNumber, relativePath)
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(dest); err == nil && info.Size() == size {
+		return Skipped, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", err
+	}
+	partPath := dest + ".part"
+	var offset int64
+	if info, err := os.Stat(partPath); err == nil && info.Size() < size {
+		offset = info.Size()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET",
+		j.artifactURL(jobName, buildNumber, relativePath), nil)
+	if err != nil {
+		return "", err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := j.open(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	result := Downloaded
+	if offset > 0 && resp.StatusCode == http.StatusPartialContent {
+		flags = os.O_WRONLY | os.O_APPEND
+		result = Resumed
+	}
+	out, err := os.OpenFile(partPath, flags, 0644)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(out, resp.Body)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	return result, os.Rename(partPath, dest)
+}
+
+// isNotParameterized tells if Jenkins refused buildWithParameters because
+// the job has no parameters
+func isNotParameterized(err error) bool {
+	var httpErr *HTTPError
+	return errors.As(err, &httpErr) &&
+		httpErr.StatusCode == http.StatusBadRequest &&
+		strings.Contains(httpErr.Body, "is not parameterized")
+}
+
+// QueueBuild asks Jenkins to schedule a build and returns the id of the
+// queue item that tracks the request
+func (j *Jenkins) QueueBuild(ctx context.Context, jobName string, params map[string]string) (string, error) {
+	values := url.Values{}
+	for key, value := range params {
+		values.Set(key, value)
+	}
+	// "build" rejects parameterized jobs, "buildWithParameters" fills in
+	// the default values of the parameters that are not given
+	location, err := j.postRequest(ctx,
+		jobPath(jobName)+"/buildWithParameters", values)
+	if len(params) == 0 && isNotParameterized(err) {
+		location, err = j.postRequest(ctx, jobPath(jobName)+"/build",
+			values)
+	}
+	if err != nil {
+		return "", err
+	}
+	// Location: https://jenkins.example.com/queue/item/1234/
+	parsed, err := url.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	itemPath := strings.TrimSuffix(parsed.Path, "/")
+	if path.Base(path.Dir(itemPath)) != "item" {
+		return "", fmt.Errorf(
+			"job %s start failed: unexpected queue location %q",
+			jobName, location)
+	}
+	return path.Base(itemPath), nil
+}
+
+// QueryQueueItem returns the current state of a queue item, a non-nil
+// Executable means the build has been assigned its build number
+func (j *Jenkins) QueryQueueItem(ctx context.Context, queueItem string) (*QueueItem, error) {
+	itemJSON, err := j.jsonRequest(ctx, "queue/item", queueItem,
+		"?tree=cancelled,why,executable[number,url]")
+	if err != nil {
+		return nil, err
+	}
+	var item QueueItem
+	if err = decodeJSON(itemJSON, &item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// ResolveQueueItem returns the build number Jenkins assigned to a queue
+// item, or an empty string when the build is still waiting in the queue
+func (j *Jenkins) ResolveQueueItem(ctx context.Context, jobName, queueItem string) (string, error) {
+	item, err := j.QueryQueueItem(ctx, queueItem)
+	if err != nil {
+		// Jenkins forgets queue items a few minutes after they have
+		// left the queue, look for a build that remembers its origin
+		buildNumber, lookupErr := j.findQueuedBuild(ctx, jobName, queueItem)
+		if lookupErr != nil || buildNumber == "" {
+			return "", err
+		}
+		return buildNumber, nil
+	}
+	switch {
+	case item.Cancelled:
+		return "", ErrQueueItemCancelled
+	case item.Executable != nil:
+		return strconv.Itoa(item.Executable.Number), nil
+	}
+	return "", nil
+}
+
+// findQueuedBuild looks for the build started from a queue item, newest
+// builds first. Queue ids grow over time, so the search ends at the first
+// build that was queued before the item.
+func (j *Jenkins) findQueuedBuild(ctx context.Context, jobName, queueItem string) (string, error) {
+	queueID, err := strconv.Atoi(queueItem)
+	if err != nil {
+		return "", fmt.Errorf("invalid queue item %q", queueItem)
+	}
+	for from := 0; ; from += historyPageSize {
+		buildsJSON, err := j.jsonRequest(ctx, jobPath(jobName), "",
+			fmt.Sprintf("?tree=allBuilds[number,queueId]{%d,%d}", from,
+				from+historyPageSize))
+		if err != nil {
+			return "", err
+		}
+		var builds JobBuilds
+		if err = decodeJSON(buildsJSON, &builds); err != nil {
+			return "", err
+		}
+		for _, build := range builds.AllBuilds {
+			if build.QueueID == queueID {
+				return strconv.Itoa(build.Number), nil
+			} else if build.QueueID > 0 && build.QueueID < queueID {
+				return "", nil
+			}
+		}
+		if len(builds.AllBuilds) < historyPageSize {
+			return "", nil
+		}
+	}
+}
+
+// StartBuild queues a build and waits at most timeout for Jenkins to assign
+// a build number to it. Unlike the SSH CLI, every request gets a queue item
+// of its own, so parallel starts never see the same build number. An empty
+// build number with a nil error means the build is still in the queue and
+// can be resolved later with ResolveQueueItem, as can a build whose queue
+// item is returned along with an error other than ErrQueueItemCancelled.
+// Cancelling ctx only cuts the wait short, the queue request is always
+// completed so that its outcome is known.
+func (j *Jenkins) StartBuild(ctx context.Context, jobName string,
+	params map[string]string, timeout time.Duration) (buildNumber,
+	queueItem string, err error) {
+	queueItem, err = j.QueueBuild(context.WithoutCancel(ctx), jobName,
+		params)
+	if err != nil {
+		return "", "", err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		buildNumber, err = j.ResolveQueueItem(ctx, jobName, queueItem)
+		if ctx.Err() != nil {
+			return "", queueItem, nil // resolved later
+		}
+		if err != nil || buildNumber != "" {
+			return buildNumber, queueItem, err
+		}
+		if time.Now().Add(queuePollInterval).After(deadline) {
+			return "", queueItem, nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", queueItem, nil
+		case <-time.After(queuePollInterval):
+		}
+	}
+}
@@ -0,0 +1,512 @@
+package jenkins
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func fakeJenkins(t *testing.T, routes map[string]string) *Jenkins {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			file, ok := routes[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			data, err := os.ReadFile(file)
+			if err != nil {
+				t.Error(err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(data)
+		}))
+	t.Cleanup(server.Close)
+	return MakeJenkins("test", server.URL, false, nil)
+}
+
+func TestQueryStages(t *testing.T) {
+	j := fakeJenkins(t, map[string]string{
+		"/job/folder/job/pipeline/12/wfapi/describe": "testdata/synthetic-wfapi-describe.json",
+	})
+	stages, err := j.QueryStages(context.Background(), "folder/pipeline", "12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"Checkout", "Build", "Test", "Deploy"}
+	if len(stages) != len(names) {
+		t.Fatalf("got %d stages, expected %d", len(stages), len(names))
+	}
+	for i, name := range names {
+		if stages[i].Name != name {
+			t.Errorf("stage %d is %q, expected %q", i, stages[i].Name, name)
+		}
+	}
+	if stages[2].Status != "FAILED" || stages[2].DurationMillis != 31000 {
+		t.Errorf("unexpected Test stage: %+v", stages[2])
+	}
+	status := JobStatus{Stages: stages}
+	if failed := status.FailedStage(); failed != "Test" {
+		t.Errorf("failed stage is %q, expected \"Test\"", failed)
+	}
+}
+
+func TestQueryStagesNotPipeline(t *testing.T) {
+	j := fakeJenkins(t, nil)
+	stages, err := j.QueryStages(context.Background(), "freestyle", "3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stages != nil {
+		t.Errorf("expected no stages, got %+v", stages)
+	}
+	if failed := (&JobStatus{}).FailedStage(); failed != "" {
+		t.Errorf("failed stage is %q, expected none", failed)
+	}
+}
+
+func TestQueryJobStatusStages(t *testing.T) {
+	var requested []string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requested = append(requested, r.URL.Path)
+			switch r.URL.Path {
+			case "/job/free//3/api/json":
+				w.Write([]byte(`{"_class":"hudson.model.FreeStyleBuild","result":"SUCCESS"}`))
+			case "/job/pipe//4/api/json":
+				w.Write([]byte(`{"_class":"org.jenkinsci.plugins.workflow.job.WorkflowRun","result":"FAILURE"}`))
+			case "/job/pipe/4/wfapi/describe":
+				data, err := os.ReadFile("testdata/synthetic-wfapi-describe.json")
+				if err != nil {
+					t.Error(err)
+				}
+				w.Write(data)
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	defer server.Close()
+	j := MakeJenkins("test", server.URL, false, nil)
+	ctx := context.Background()
+	if _, err := j.QueryJobStatus(ctx, "free", "3", true); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range requested {
+		if strings.HasSuffix(path, "/wfapi/describe") {
+			t.Errorf("requested stages of a freestyle build: %s", path)
+		}
+	}
+	status, err := j.QueryJobStatus(ctx, "pipe", "4", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed := status.FailedStage(); failed != "Test" {
+		t.Errorf("failed stage is %q, expected \"Test\"", failed)
+	}
+}
+
+func TestCACertFile(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
+		Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	untrusted := MakeJenkins("test", server.URL, false, nil)
+	if _, err := untrusted.QueryStages(context.Background(), "job", "1"); err == nil {
+		t.Error("untrusted server certificate was accepted")
+	}
+	trusted := MakeJenkins("test", server.URL, false, nil)
+	trusted.CACertFile = caFile
+	if _, err := trusted.QueryStages(context.Background(), "job", "1"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStartBuildCancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/job/slow/buildWithParameters":
+				w.Header().Set("Location",
+					"http://"+r.Host+"/queue/item/17/")
+				w.WriteHeader(http.StatusCreated)
+			case "/queue/item/17/api/json":
+				w.Write([]byte(`{"why":"Waiting for next available executor"}`))
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	defer server.Close()
+	j := MakeJenkins("test", server.URL, false, nil)
+	ctx, cancel := context.WithTimeout(context.Background(),
+		100*time.Millisecond)
+	defer cancel()
+	buildNumber, queueItem, err := j.StartBuild(ctx, "slow", nil,
+		time.Minute)
+	if err != nil || buildNumber != "" || queueItem != "17" {
+		t.Errorf("got build %q, queue item %q, error %v, expected "+
+			"queue item 17", buildNumber, queueItem, err)
+	}
+}
+
+func TestQueueBuildWithParameters(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/crumbIssuer/api/json":
+				w.Write([]byte(`{"crumb":"c1","crumbRequestField":"Jenkins-Crumb"}`))
+			case "/job/app/buildWithParameters":
+				if r.Method != "POST" ||
+					r.Header.Get("Jenkins-Crumb") != "c1" ||
+					r.FormValue("BRANCH") != "main" {
+					t.Errorf("unexpected %s request, crumb %q, form %v",
+						r.Method, r.Header.Get("Jenkins-Crumb"), r.Form)
+				}
+				w.Header().Set("Location",
+					"http://"+r.Host+"/queue/item/33/")
+				w.WriteHeader(http.StatusCreated)
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	defer server.Close()
+	j := MakeJenkins("test", server.URL, false, nil)
+	queueItem, err := j.QueueBuild(context.Background(), "app",
+		map[string]string{"BRANCH": "main"})
+	if err != nil || queueItem != "33" {
+		t.Errorf("got queue item %q, %v, expected 33", queueItem, err)
+	}
+}
+
+func TestQueueBuildWithoutParameters(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/job/parameterized/buildWithParameters":
+				// the default values of the parameters are used
+				w.Header().Set("Location",
+					"http://"+r.Host+"/queue/item/41/")
+				w.WriteHeader(http.StatusCreated)
+			case "/job/parameterized/build":
+				http.Error(w, "Nothing is submitted",
+					http.StatusBadRequest)
+			case "/job/plain/buildWithParameters":
+				http.Error(w, "java.io.IOException: plain is not parameterized",
+					http.StatusBadRequest)
+			case "/job/plain/build":
+				w.Header().Set("Location",
+					"http://"+r.Host+"/queue/item/42/")
+				w.WriteHeader(http.StatusCreated)
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	defer server.Close()
+	j := MakeJenkins("test", server.URL, false, nil)
+	ctx := context.Background()
+	for job, expected := range map[string]string{"parameterized": "41",
+		"plain": "42"} {
+		queueItem, err := j.QueueBuild(ctx, job, nil)
+		if err != nil || queueItem != expected {
+			t.Errorf("%s: got queue item %q, %v, expected %s", job,
+				queueItem, err, expected)
+		}
+	}
+	// parameters are never dropped silently
+	if _, err := j.QueueBuild(ctx, "plain",
+		map[string]string{"BRANCH": "main"}); err == nil {
+		t.Error("expected an error for parameters of a plain job")
+	}
+}
+
+func TestQueryJobsInFolders(t *testing.T) {
+	containers := map[string]string{
+		"/view/All":              `{"jobs":[{"name":"tools"},{"name":"my team","jobs":[]}]}`,
+		"/job/my%20team":         `{"jobs":[{"name":"app","jobs":[]}]}`,
+		"/job/my%20team/job/app": `{"jobs":[{"name":"master"},{"name":"feature%2Fx"}]}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			container := strings.TrimSuffix(strings.TrimSuffix(
+				r.URL.EscapedPath(), "/api/json"), "/")
+			data, ok := containers[container]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write([]byte(data))
+		}))
+	defer server.Close()
+	j := MakeJenkins("test", server.URL, false, nil)
+	jobs, err := j.QueryJobs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"tools", "my team/app/master",
+		"my team/app/feature%2Fx"}
+	if !reflect.DeepEqual(jobs, expected) {
+		t.Errorf("got jobs %q, expected %q", jobs, expected)
+	}
+	// multibranch jobs keep the escaped branch name, which is escaped again
+	// in URLs
+	if path := jobPath(jobs[2]); path !=
+		"job/my%20team/job/app/job/feature%252Fx" {
+		t.Errorf("got path %s", path)
+	}
+}
+
+func TestQueryJobHistoryPages(t *testing.T) {
+	const total = 250
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			var from, to int
+			tree := r.URL.Query().Get("tree")
+			_, err := fmt.Sscanf(tree[strings.LastIndex(tree, "{"):],
+				"{%d,%d}", &from, &to)
+			if err != nil || !strings.HasPrefix(tree, "allBuilds[") {
+				t.Errorf("unexpected tree %q", tree)
+			}
+			var builds []string
+			for i := from; i < to && i < total; i++ {
+				builds = append(builds, fmt.Sprintf(
+					`{"number":%d,"result":"SUCCESS"}`, total-i))
+			}
+			fmt.Fprintf(w, `{"allBuilds":[%s]}`,
+				strings.Join(builds, ","))
+		}))
+	defer server.Close()
+	j := MakeJenkins("test", server.URL, false, nil)
+	builds, err := j.QueryJobHistory(context.Background(), "big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != total || builds[0] != "250" || builds[total-1] != "1" {
+		t.Fatalf("got %d builds, expected builds %d to 1", len(builds), total)
+	}
+	if requests != 3 {
+		t.Errorf("got %d requests, expected 3 pages", requests)
+	}
+	if summary := j.historySummary("big", "120"); summary == nil ||
+		summary.Result != "SUCCESS" {
+		t.Errorf("got summary %+v for build 120", summary)
+	}
+}
+
+func TestBuildDeleted(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/job/app//api/json":
+				w.Write([]byte(`{"name":"app"}`))
+			case "/job/app/5/api/json":
+				w.Write([]byte(`{"number":5}`))
+			default:
+				http.NotFound(w, r) // also unreadable jobs
+			}
+		}))
+	defer server.Close()
+	j := MakeJenkins("test", server.URL, false, nil)
+	ctx := context.Background()
+	for build, expected := range map[string]bool{"4": true, "5": false} {
+		deleted, err := j.BuildDeleted(ctx, "app", build)
+		if err != nil || deleted != expected {
+			t.Errorf("build %s: got %v, %v, expected %v", build, deleted,
+				err, expected)
+		}
+	}
+	if deleted, err := j.BuildDeleted(ctx, "secret", "1"); err == nil ||
+		deleted {
+		t.Errorf("got %v, %v for an unreadable job, expected an error",
+			deleted, err)
+	}
+}
+
+func TestQueryPromotions(t *testing.T) {
+	cause := func(number, job string, build int) string {
+		return fmt.Sprintf(`{"number":%s,"result":"SUCCESS",`+
+			`"timestamp":2000,"actions":[{"causes":[{"upstreamProject":`+
+			`%q,"upstreamBuild":%d}]}]}`, number, job, build)
+	}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/job/app//7/api/json", "/job/plain//7/api/json":
+				w.Write([]byte(`{"result":"SUCCESS","timestamp":1000}`))
+			case "/job/app/promotion/api/json":
+				w.Write([]byte(`{"processes":[{"name":"QA"},` +
+					`{"name":"Release Candidate"}]}`))
+			case "/job/app/promotion/process/QA/api/json":
+				fmt.Fprintf(w, `{"allBuilds":[%s,%s,%s]}`,
+					cause("3", "app", 8), cause("2", "app", 7),
+					cause("1", "other", 7))
+			case "/job/app/promotion/process/Release Candidate/api/json":
+				fmt.Fprintf(w, `{"allBuilds":[%s]}`, cause("1", "app", 7))
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	defer server.Close()
+	j := MakeJenkins("test", server.URL, false, nil)
+	promotions, err := j.QueryPromotions(context.Background(), "app", "7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, promotion := range promotions {
+		got = append(got, promotion.Process+" #"+promotion.BuildNumber+
+			" "+promotion.Status.Result)
+	}
+	expected := []string{"QA #2 SUCCESS", "Release Candidate #1 SUCCESS"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got promotions %q, expected %q", got, expected)
+	}
+	promotions, err = j.QueryPromotions(context.Background(), "plain", "7")
+	if err != nil || len(promotions) != 0 {
+		t.Errorf("got %v, %v for a job without promotions", promotions, err)
+	}
+}
+
+func TestArtifactURL(t *testing.T) {
+	j := MakeJenkins("test", "https://ci", false, nil)
+	got := j.artifactURL("team/app", "7", "out dir/a+b #1.txt")
+	expected := "https://ci/job/team/job/app/7/artifact/out%20dir/a+b%20%231.txt"
+	if got != expected {
+		t.Errorf("got %s, expected %s", got, expected)
+	}
+}
+
+func TestOffline(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("offline client requested %s", r.URL)
+		}))
+	defer server.Close()
+	j := MakeJenkins("test", server.URL, false,
+		&JobCache{CacheDir: t.TempDir()})
+	j.Offline = true
+	err := j.JobCache.Store("test", "job", "1", &JobStatus{Result: "FAILURE"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for build, result := range map[string]string{"1": "FAILURE", "2": "UNKNOWN"} {
+		status, err := j.QueryJobStatus(ctx, "job", build, true)
+		if err != nil || status.Result != result {
+			t.Errorf("build %s: got %+v, %v, expected %s", build, status,
+				err, result)
+		}
+	}
+	if _, err := j.QueryJobHistory(ctx, "job"); !errors.Is(err, ErrOffline) {
+		t.Errorf("got %v for history, expected %v", err, ErrOffline)
+	}
+}
+
+func TestResolveQueueItem(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/job/fast/buildWithParameters":
+				w.Header().Set("Location",
+					"http://"+r.Host+"/queue/item/21/")
+				w.WriteHeader(http.StatusCreated)
+			case "/queue/item/21/api/json":
+				w.Write([]byte(`{"executable":{"number":42,"url":"x"}}`))
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	defer server.Close()
+	j := MakeJenkins("test", server.URL, false, nil)
+	buildNumber, queueItem, err := j.StartBuild(context.Background(),
+		"fast", nil, time.Minute)
+	if err != nil || buildNumber != "42" || queueItem != "21" {
+		t.Errorf("got build %q, queue item %q, error %v, expected build "+
+			"42 from queue item 21", buildNumber, queueItem, err)
+	}
+}
+
+func TestStartBuildQueueItemFailing(t *testing.T) {
+	defer func(delay time.Duration) { retryBaseDelay = delay }(retryBaseDelay)
+	retryBaseDelay = time.Millisecond
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/job/app/buildWithParameters":
+				w.Header().Set("Location",
+					"http://"+r.Host+"/queue/item/51/")
+				w.WriteHeader(http.StatusCreated)
+			case strings.HasPrefix(r.URL.Path, "/crumbIssuer/"):
+				http.NotFound(w, r)
+			default:
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+	defer server.Close()
+	j := MakeJenkins("test", server.URL, false, nil)
+	buildNumber, queueItem, err := j.StartBuild(context.Background(),
+		"app", nil, time.Minute)
+	if !errors.Is(err, ErrServer) || buildNumber != "" || queueItem != "51" {
+		t.Errorf("got build %q, queue item %q, error %v, expected queue "+
+			"item 51 with %v", buildNumber, queueItem, err, ErrServer)
+	}
+}
+
+func TestResolveForgottenQueueItem(t *testing.T) {
+	defer func(size int) { historyPageSize = size }(historyPageSize)
+	historyPageSize = 2
+	var pages []string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if !strings.HasPrefix(r.URL.Path, "/job/busy/") {
+				http.NotFound(w, r) // the queue item is forgotten
+				return
+			}
+			tree := r.URL.Query().Get("tree")
+			pages = append(pages, tree)
+			switch tree {
+			case "allBuilds[number,queueId]{0,2}":
+				w.Write([]byte(`{"allBuilds":[{"number":9,"queueId":90},{"number":8,"queueId":80}]}`))
+			case "allBuilds[number,queueId]{2,4}":
+				w.Write([]byte(`{"allBuilds":[{"number":7,"queueId":70},{"number":6,"queueId":60}]}`))
+			default:
+				w.Write([]byte(`{"allBuilds":[]}`))
+			}
+		}))
+	defer server.Close()
+	j := MakeJenkins("test", server.URL, false, nil)
+	ctx := context.Background()
+	buildNumber, err := j.ResolveQueueItem(ctx, "busy", "70")
+	if err != nil || buildNumber != "7" {
+		t.Errorf("got build %q, %v, expected 7", buildNumber, err)
+	}
+	if len(pages) != 2 {
+		t.Errorf("got history requests %q, expected 2", pages)
+	}
+	pages = nil
+	buildNumber, err = j.ResolveQueueItem(ctx, "busy", "75")
+	if !errors.Is(err, ErrNotFound) || buildNumber != "" {
+		t.Errorf("got build %q, %v, expected %v", buildNumber, err,
+			ErrNotFound)
+	}
+	if len(pages) != 2 {
+		t.Errorf("got history requests %q, expected the search to end at "+
+			"an older queue id", pages)
+	}
+}
@@ -0,0 +1,89 @@
+/*
+Package jenkins - Tolerant JSON Decoding
+
+Copyright (c) 2014 Ohmu Ltd.
+Licensed under the Apache License, Version 2.0 (see LICENSE)
+*/
+package jenkins
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Jenkins serializes non-finite doubles as bare NaN, Infinity and -Infinity,
+// e.g. '{"duration":NaN,"failCount":5,"passCount":4422}', which is not JSON
+var nonFiniteLiterals = [][]byte{
+	[]byte("NaN"), []byte("Infinity"), []byte("-Infinity")}
+
+// decodeJSON parses a Jenkins response, decoding non-finite numbers as null
+func decodeJSON(data []byte, v interface{}) error {
+	return json.Unmarshal(sanitizeJSON(data), v)
+}
+
+// sanitizeJSON replaces the non-finite number literals that appear as
+// values with null, leaving strings and any other input untouched
+func sanitizeJSON(data []byte) []byte {
+	if !bytes.Contains(data, nonFiniteLiterals[0]) &&
+		!bytes.Contains(data, nonFiniteLiterals[1]) {
+		return data
+	}
+	out := make([]byte, 0, len(data)+16)
+	inString, escaped := false, false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case inString:
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		default:
+			if n := nonFiniteLiteral(data, i); n > 0 {
+				out = append(out, "null"...)
+				i += n - 1
+				continue
+			}
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// nonFiniteLiteral returns the length of a NaN, Infinity or -Infinity value
+// token starting at data[i], or zero
+func nonFiniteLiteral(data []byte, i int) int {
+	if i > 0 && !isValueStart(data[i-1]) {
+		return 0 // e.g. the tail of another literal or number
+	}
+	for _, literal := range nonFiniteLiterals {
+		end := i + len(literal)
+		if bytes.HasPrefix(data[i:], literal) &&
+			(end == len(data) || isValueEnd(data[end])) {
+			return len(literal)
+		}
+	}
+	return 0
+}
+
+func isValueStart(c byte) bool {
+	switch c {
+	case ':', ',', '[', ' ', '\t', '\r', '\n':
+		return true
+	}
+	return false
+}
+
+func isValueEnd(c byte) bool {
+	switch c {
+	case ',', '}', ']', ' ', '\t', '\r', '\n':
+		return true
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package jenkins
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSanitizeJSON(t *testing.T) {
+	cases := []struct{ in, out string }{
+		{`{"a":NaN,"b":1}`, `{"a":null,"b":1}`},
+		{`{"a":NaN}`, `{"a":null}`},
+		{`[Infinity, -Infinity,NaN]`, `[null, null,null]`},
+		{`{"a": -Infinity }`, `{"a": null }`},
+		{`NaN`, `null`},
+		{`{"a":"NaN","b":":NaN,"}`, `{"a":"NaN","b":":NaN,"}`},
+		{`{"a":"\"NaN\\","b":NaN}`, `{"a":"\"NaN\\","b":null}`},
+		{`{"NaN":1,"Infinity":-1e5}`, `{"NaN":1,"Infinity":-1e5}`},
+		{`{"a":NaNx}`, `{"a":NaNx}`},
+		{`{"a":xNaN}`, `{"a":xNaN}`},
+	}
+	for _, c := range cases {
+		if got := string(sanitizeJSON([]byte(c.in))); got != c.out {
+			t.Errorf("sanitizeJSON(%s) = %s, expected %s", c.in, got, c.out)
+		}
+	}
+}
+
+func TestDecodeTestReport(t *testing.T) {
+	data, err := os.ReadFile("testdata/synthetic-testreport-nan.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report TestReport
+	if err := decodeJSON(data, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.FailCount != 2 || report.PassCount != 4422 ||
+		len(report.Suites) != 1 || len(report.Suites[0].Cases) != 4 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	cases := report.Suites[0].Cases
+	if cases[0].Name != `test_literal[":NaN,"]` {
+		t.Errorf("test name was altered: %q", cases[0].Name)
+	}
+	if cases[1].Duration != 0 || cases[1].Status != "FAILED" {
+		t.Errorf("unexpected case: %+v", cases[1])
+	}
+}
+
+func TestDecodePayloads(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var generic interface{}
+		if err := decodeJSON(data, &generic); err != nil {
+			t.Errorf("%s: %s", file, err)
+		}
+	}
+}
+
+func loadPayloads(f *testing.F) {
+	files, err := filepath.Glob("testdata/*.json")
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+}
+
+func FuzzSanitizeJSON(f *testing.F) {
+	loadPayloads(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		sanitized := sanitizeJSON(data)
+		if json.Valid(data) && !bytes.Equal(data, sanitized) {
+			t.Fatalf("valid JSON was modified: %q -> %q", data, sanitized)
+		}
+		if again := sanitizeJSON(sanitized); !bytes.Equal(again, sanitized) {
+			t.Fatalf("not idempotent: %q -> %q", sanitized, again)
+		}
+	})
+}
+
+func FuzzDecodeJSON(f *testing.F) {
+	loadPayloads(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var status JobStatus
+		var history JobHistory
+		var report TestReport
+		// must not panic, errors are fine for garbage
+		decodeJSON(data, &status)
+		decodeJSON(data, &history)
+		decodeJSON(data, &report)
+		var generic interface{}
+		if decodeJSON(data, &generic) == nil {
+			if _, err := json.Marshal(generic); err != nil {
+				t.Fatalf("decoded a non-finite number: %s", err)
+			}
+		}
+	})
+}
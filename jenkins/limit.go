@@ -0,0 +1,74 @@
+/*
+Package jenkins - Request Limits
+
+Copyright (c) 2014 Ohmu Ltd.
+Licensed under the Apache License, Version 2.0 (see LICENSE)
+*/
+package jenkins
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// requestLimiter bounds the number of parallel requests and spaces out the
+// start of consecutive requests
+type requestLimiter struct {
+	slots    chan struct{}
+	interval time.Duration // zero for no rate limit
+	mutex    sync.Mutex
+	next     time.Time // earliest start of the next request
+}
+
+func newRequestLimiter(concurrency int, perSecond float64) *requestLimiter {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	limiter := &requestLimiter{slots: make(chan struct{}, concurrency)}
+	if perSecond > 0 {
+		limiter.interval = time.Duration(float64(time.Second) / perSecond)
+	}
+	return limiter
+}
+
+// acquire blocks until a request may be sent, the caller must release
+// unless an error is returned
+func (l *requestLimiter) acquire(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case l.slots <- struct{}{}:
+	}
+	if l.interval == 0 {
+		return nil
+	}
+	l.mutex.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mutex.Unlock()
+	select {
+	case <-ctx.Done():
+		l.release()
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+func (l *requestLimiter) release() {
+	<-l.slots
+}
+
+// limiter returns the request limiter of the instance
+func (j *Jenkins) limiter() *requestLimiter {
+	j.limiterOnce.Do(func() {
+		j.requests = newRequestLimiter(j.MaxConcurrency,
+			j.RequestsPerSecond)
+	})
+	return j.requests
+}
@@ -0,0 +1,49 @@
+package jenkins
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRequestLimiterConcurrency(t *testing.T) {
+	limiter := newRequestLimiter(3, 0)
+	var running, maxRunning int32
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			limiter.acquire(context.Background())
+			defer limiter.release()
+			n := atomic.AddInt32(&running, 1)
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		}()
+	}
+	wg.Wait()
+	if maxRunning > 3 {
+		t.Errorf("%d requests ran in parallel, limit is 3", maxRunning)
+	}
+}
+
+func TestRequestLimiterRate(t *testing.T) {
+	limiter := newRequestLimiter(10, 100)
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		limiter.acquire(context.Background())
+		limiter.release()
+	}
+	// the first request starts immediately, the rest 10ms apart
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("6 requests took %s at 100 requests per second", elapsed)
+	}
+}
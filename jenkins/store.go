@@ -0,0 +1,362 @@
+/*
+Package jenkins - Single File Build Store
+
+Copyright (c) 2014 Ohmu Ltd.
+Licensed under the Apache License, Version 2.0 (see LICENSE)
+*/
+package jenkins
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// The store is an append-only log of records, a record replaces the
+// earlier records of the same key and a record with an empty value removes
+// the key. Each record is
+//
+//	crc32 | key size | value size | fetched | key | value
+//
+// with the sizes as little endian uint32s, fetched as little endian int64
+// unix nanoseconds and the checksum covering everything after it. The index
+// of the latest records is built from the record headers in one pass when
+// the store is opened, the values are only read on lookups.
+//
+// Several processes may use the store at once. Appends hold a shared lock
+// on the file, while scanning, which may truncate a partial record, and
+// compacting hold an exclusive lock. Compacting replaces the file, so the
+// other processes reopen it before their next append.
+
+const storeMagic = "TJOBDB1\n"
+
+const (
+	recordHeaderSize = 20
+	maxKeySize       = 1 << 16
+	maxValueSize     = 1 << 28
+	scanKeySize      = 256 // keys read along with the header when scanning
+)
+
+// compactMinSize is the store size below which garbage is left alone
+var compactMinSize int64 = 1 << 20
+
+type recordRef struct {
+	offset    int64
+	keySize   uint32
+	valueSize uint32
+	fetched   int64
+}
+
+func (r recordRef) size() int64 {
+	return recordHeaderSize + int64(r.keySize) + int64(r.valueSize)
+}
+
+type store struct {
+	path  string
+	mutex sync.RWMutex
+	file  *os.File
+	index map[string]recordRef
+	size  int64 // bytes of records, live or not
+	live  int64 // bytes of the indexed records
+}
+
+func openStore(path string) (*store, error) {
+	s := &store{path: path}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	if s.size > compactMinSize && s.size > 2*s.live {
+		if err := s.Compact(); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// open reads the index of the store file, creating it when missing
+func (s *store) open() error {
+	for {
+		file, err := os.OpenFile(s.path,
+			os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		if err = lockFile(file, true); err != nil {
+			file.Close()
+			return err
+		}
+		s.file = file
+		replaced, err := s.replaced()
+		if err == nil && !replaced {
+			err = s.scan()
+			if err == nil {
+				return unlockFile(file)
+			}
+			err = fmt.Errorf("build store %s: %s", s.path, err)
+		}
+		file.Close() // releases the lock
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// replaced tells if another process has replaced the store file since it
+// was opened
+func (s *store) replaced() (bool, error) {
+	opened, err := s.file.Stat()
+	if err != nil {
+		return false, err
+	}
+	current, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return !os.SameFile(opened, current), nil
+}
+
+// lockCurrent locks the store file, reopening it first if it has been
+// replaced, the caller holds the write lock
+func (s *store) lockCurrent(exclusive bool) error {
+	for {
+		if err := lockFile(s.file, exclusive); err != nil {
+			return err
+		}
+		replaced, err := s.replaced()
+		if err == nil && !replaced {
+			return nil
+		}
+		s.file.Close() // releases the lock
+		if err != nil {
+			return err
+		}
+		if err = s.open(); err != nil {
+			return err
+		}
+	}
+}
+
+// scan builds the index, the caller holds an exclusive file lock
+func (s *store) scan() error {
+	s.index = make(map[string]recordRef)
+	s.size, s.live = 0, 0
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	end := info.Size()
+	if end == 0 {
+		_, err = s.file.Write([]byte(storeMagic))
+		return err
+	}
+	magic := make([]byte, len(storeMagic))
+	if _, err = s.file.ReadAt(magic, 0); err != nil ||
+		string(magic) != storeMagic {
+		return fmt.Errorf("not a build store")
+	}
+	buf := make([]byte, recordHeaderSize+scanKeySize)
+	offset := int64(len(storeMagic))
+	for offset < end {
+		n, err := s.file.ReadAt(buf, offset)
+		if n < recordHeaderSize {
+			if err != nil && err != io.EOF {
+				return err
+			}
+			break // truncated header
+		}
+		ref := recordRef{offset: offset,
+			keySize:   binary.LittleEndian.Uint32(buf[4:]),
+			valueSize: binary.LittleEndian.Uint32(buf[8:]),
+			fetched:   int64(binary.LittleEndian.Uint64(buf[12:]))}
+		if ref.keySize > maxKeySize || ref.valueSize > maxValueSize ||
+			offset+ref.size() > end {
+			break // an append was interrupted
+		}
+		key := buf[recordHeaderSize:min(n, len(buf))]
+		if int(ref.keySize) <= len(key) {
+			key = key[:ref.keySize]
+		} else {
+			key = make([]byte, ref.keySize)
+			_, err := s.file.ReadAt(key, offset+recordHeaderSize)
+			if err != nil {
+				return err
+			}
+		}
+		s.add(string(key), ref)
+		offset += ref.size()
+	}
+	if offset < end {
+		// drop the partial record, or the records appended after it
+		// would never be found. The lock keeps other processes from
+		// appending meanwhile, so it is not an append in progress.
+		return s.file.Truncate(offset)
+	}
+	return nil
+}
+
+// add indexes a record, the caller holds the write lock
+func (s *store) add(key string, ref recordRef) {
+	if old, exists := s.index[key]; exists {
+		s.live -= old.size()
+	}
+	if ref.valueSize == 0 {
+		delete(s.index, key)
+	} else {
+		s.index[key] = ref
+		s.live += ref.size()
+	}
+	s.size += ref.size()
+}
+
+// Get returns the value and the fetch time of a key, a corrupted record
+// is treated as missing
+func (s *store) Get(key string) ([]byte, int64, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	ref, exists := s.index[key]
+	if !exists {
+		return nil, 0, nil
+	}
+	record := make([]byte, ref.size())
+	if _, err := s.file.ReadAt(record, ref.offset); err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(record[4:]) !=
+		binary.LittleEndian.Uint32(record) {
+		return nil, 0, nil
+	}
+	return record[recordHeaderSize+int(ref.keySize):], ref.fetched, nil
+}
+
+// Put appends a record, an empty value removes the key
+func (s *store) Put(key string, value []byte, fetched int64) error {
+	if len(key) > maxKeySize || len(value) > maxValueSize {
+		return fmt.Errorf("build store record too large")
+	}
+	record := make([]byte, recordHeaderSize, recordHeaderSize+len(key)+
+		len(value))
+	binary.LittleEndian.PutUint32(record[4:], uint32(len(key)))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(value)))
+	binary.LittleEndian.PutUint64(record[12:], uint64(fetched))
+	record = append(append(record, key...), value...)
+	binary.LittleEndian.PutUint32(record, crc32.ChecksumIEEE(record[4:]))
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, exists := s.index[key]; !exists && len(value) == 0 {
+		return nil // nothing to remove
+	}
+	if err := s.lockCurrent(false); err != nil {
+		return err
+	}
+	defer unlockFile(s.file)
+	// a single write to an O_APPEND file is not interleaved with the
+	// writes of other processes, and leaves the file offset at its end
+	if _, err := s.file.Write(record); err != nil {
+		return err
+	}
+	end, err := s.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	s.add(key, recordRef{offset: end - int64(len(record)),
+		keySize: uint32(len(key)), valueSize: uint32(len(value)),
+		fetched: fetched})
+	return nil
+}
+
+// Keys calls fn for each key with its value size and fetch time
+func (s *store) Keys(fn func(key string, size int64, fetched int64)) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for key, ref := range s.index {
+		fn(key, int64(ref.valueSize), ref.fetched)
+	}
+}
+
+// Compact rewrites the store with only the latest records, including the
+// ones appended by other processes
+func (s *store) Compact() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.lockCurrent(true); err != nil {
+		return err
+	}
+	err := s.compact()
+	if err != nil {
+		unlockFile(s.file)
+		return err
+	}
+	// the other processes wait for the lock on the old file until it is
+	// closed, and then notice that it has been replaced
+	s.file.Close()
+	return s.open()
+}
+
+func (s *store) compact() error {
+	if err := s.scan(); err != nil {
+		return fmt.Errorf("build store %s: %s", s.path, err)
+	}
+	refs := make([]recordRef, 0, len(s.index))
+	for _, ref := range s.index {
+		refs = append(refs, ref)
+	}
+	// keep the order of appends, and read the old file sequentially
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].offset < refs[j].offset
+	})
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath) // no-op after a successful rename
+	err = s.copyRecords(tmp, refs)
+	if syncErr := tmp.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
+
+func (s *store) copyRecords(out io.Writer, refs []recordRef) error {
+	if _, err := io.WriteString(out, storeMagic); err != nil {
+		return err
+	}
+	var record []byte
+	for _, ref := range refs {
+		if int64(cap(record)) < ref.size() {
+			record = make([]byte, ref.size())
+		}
+		record = record[:ref.size()]
+		if _, err := s.file.ReadAt(record, ref.offset); err != nil {
+			return err
+		}
+		if crc32.ChecksumIEEE(record[4:]) !=
+			binary.LittleEndian.Uint32(record) {
+			continue // corrupted, drop it
+		}
+		if _, err := out.Write(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *store) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.file.Close()
+}
@@ -8,6 +8,8 @@ package jenkins
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -28,11 +30,41 @@ func (d *Duration) String() string {
 }
 
 type Cause struct {
-	UserID string
+	UserID          string
+	UpstreamProject string
+	UpstreamBuild   int
+}
+
+// BuildRef identifies a build of a job on the same Jenkins
+type BuildRef struct {
+	JobName     string
+	BuildNumber string
+}
+
+// Promotion is a build of a promotion process, promotions are triggered
+// with an upstream cause pointing to the promoted build
+type Promotion struct {
+	Process     string
+	BuildNumber string
+	Status      *JobStatus
+}
+
+type Parameter struct {
+	Name  string
+	Value interface{} // string, bool, number, or nil for e.g. passwords
 }
 
 type Action struct {
-	Causes []Cause
+	Causes     []Cause
+	Parameters []Parameter
+	// SCM build data, one action per checked out repository
+	LastBuiltRevision *GitRevision
+	RemoteURLs        []string
+	SCMName           string
+	// test result action counts, only requested in build summaries
+	FailCount  Count
+	SkipCount  Count
+	TotalCount Count
 }
 
 type JobStatus struct {
@@ -42,17 +74,116 @@ type JobStatus struct {
 	Duration
 	BuiltOn string
 	URL     string
+	Class   string `json:"_class,omitempty"` // Java class of the build
 	*TestReport
-	Actions []Action
-	XUserID string // moved from "causes"
+	Actions     []Action
+	XUserID     string            // moved from "causes"
+	XParameters map[string]string // moved from "parameters"
+	XUpstream   []BuildRef        // moved from "causes"
 	*GitStatus
+	Artifacts  []Artifact
+	ChangeSets []ChangeSet
+	ChangeSet  *ChangeSet `json:",omitempty"` // pre-2.60 Jenkins, moved to ChangeSets
+	Stages     []Stage
+}
+
+// Stage is a Pipeline stage from the "wfapi/describe" stage view API
+type Stage struct {
+	ID              string
+	Name            string
+	Status          string // SUCCESS, FAILED, UNSTABLE, ABORTED, IN_PROGRESS, ...
+	StartTimeMillis Timestamp
+	DurationMillis  Duration
+}
+
+// HasStages tells if the build may have Pipeline stages, builds of
+// Jenkins versions that do not report the class may have them
+func (j *JobStatus) HasStages() bool {
+	return j.Class == "" || strings.HasSuffix(j.Class, ".WorkflowRun")
+}
+
+// FailedStage returns the name of the first stage that did not succeed
+func (j *JobStatus) FailedStage() string {
+	for _, stage := range j.Stages {
+		switch stage.Status {
+		case "FAILED", "UNSTABLE", "ABORTED":
+			return stage.Name
+		}
+	}
+	return ""
+}
+
+type ChangeSet struct {
+	Kind  string
+	Items []ChangeSetItem
+}
+
+type ChangeSetItem struct {
+	CommitID string
+	Author   struct {
+		FullName string
+	}
+	Msg           string
+	AffectedPaths []string
+}
+
+// Title returns the first line of the commit message
+func (c ChangeSetItem) Title() string {
+	return strings.SplitN(c.Msg, "\n", 2)[0]
+}
+
+// Changes returns the commits of all the change sets of the build
+func (j *JobStatus) Changes() []ChangeSetItem {
+	var changes []ChangeSetItem
+	for _, changeSet := range j.ChangeSets {
+		changes = append(changes, changeSet.Items...)
+	}
+	return changes
+}
+
+// Authors returns the distinct authors of the commits in the build
+func (j *JobStatus) Authors() []string {
+	var authors []string
+	seen := make(map[string]bool)
+	for _, change := range j.Changes() {
+		if name := change.Author.FullName; !seen[name] {
+			seen[name] = true
+			authors = append(authors, name)
+		}
+	}
+	return authors
+}
+
+type Artifact struct {
+	FileName     string
+	RelativePath string
 }
 
 func (j *JobStatus) HasTestReport() bool {
 	return j.TestReport != nil
 }
 
+// HasUpstream tells if the build was triggered by the given build
+func (j *JobStatus) HasUpstream(jobName, buildNumber string) bool {
+	for _, upstream := range j.XUpstream {
+		if upstream.JobName == jobName &&
+			upstream.BuildNumber == buildNumber {
+			return true
+		}
+	}
+	return false
+}
+
 func (j *JobStatus) Prune() {
+	for _, action := range j.Actions {
+		for _, cause := range action.Causes {
+			if cause.UpstreamProject != "" {
+				j.XUpstream = append(j.XUpstream, BuildRef{
+					cause.UpstreamProject,
+					strconv.Itoa(cause.UpstreamBuild)})
+			}
+		}
+	}
 ALL:
 	for _, action := range j.Actions {
 		for _, cause := range action.Causes {
@@ -62,43 +193,151 @@ ALL:
 			}
 		}
 	}
+	for _, action := range j.Actions {
+		for _, param := range action.Parameters {
+			if j.XParameters == nil {
+				j.XParameters = make(map[string]string)
+			}
+			if param.Value != nil {
+				j.XParameters[param.Name] = fmt.Sprint(param.Value)
+			} else {
+				j.XParameters[param.Name] = ""
+			}
+		}
+		if action.LastBuiltRevision != nil {
+			if j.GitStatus == nil {
+				j.GitStatus = &GitStatus{}
+			}
+			j.GitStatus.Repositories = append(j.GitStatus.Repositories,
+				GitRepository{*action.LastBuiltRevision,
+					action.RemoteURLs, action.SCMName})
+		}
+		if j.TestReport == nil && action.TotalCount > 0 {
+			// summary without test cases
+			j.TestReport = &TestReport{
+				FailCount: action.FailCount,
+				PassCount: action.TotalCount - action.FailCount -
+					action.SkipCount,
+				SkipCount: action.SkipCount,
+				Suites:    []*Suite{},
+			}
+		}
+	}
 	j.Actions = nil
+	if j.ChangeSet != nil {
+		if len(j.ChangeSets) == 0 && len(j.ChangeSet.Items) > 0 {
+			j.ChangeSets = []ChangeSet{*j.ChangeSet}
+		}
+		j.ChangeSet = nil
+	}
 }
 
-type GitStatus struct {
-	LastBuiltRevision struct {
-		Branch []struct {
-			SHA1 string
-			Name string
+type GitBranch struct {
+	SHA1 string
+	Name string
+}
+
+type GitRevision struct {
+	SHA1   string
+	Branch []GitBranch
+}
+
+// GitRepository is the build data of one checked out repository
+type GitRepository struct {
+	LastBuiltRevision GitRevision
+	RemoteURLs        []string
+	SCMName           string
+}
+
+// CommitID returns the built revision of the repository
+func (r *GitRepository) CommitID() string {
+	if r.LastBuiltRevision.SHA1 != "" {
+		return r.LastBuiltRevision.SHA1
+	}
+	for _, branch := range r.LastBuiltRevision.Branch {
+		if branch.SHA1 != "" {
+			return branch.SHA1
+		}
+	}
+	return ""
+}
+
+func (r *GitRepository) Branch() string {
+	for _, branch := range r.LastBuiltRevision.Branch {
+		if branch.Name != "" {
+			return branch.Name
 		}
 	}
-	RemoteURLs []string
+	return ""
+}
+
+// GitStatus lists the repositories checked out by a build, nil when the
+// build has no SCM build data
+type GitStatus struct {
+	Repositories []GitRepository
 }
 
+// CommitID returns the revision of the first repository
 func (g *GitStatus) CommitID() string {
 	if g == nil {
 		return ""
 	}
-	for _, branch := range g.LastBuiltRevision.Branch {
-		if branch.SHA1 != "" {
-			return branch.SHA1
+	for _, repo := range g.Repositories {
+		if commitID := repo.CommitID(); commitID != "" {
+			return commitID
 		}
 	}
 	return ""
 }
 
+// Branch returns the branch of the first repository
 func (g *GitStatus) Branch() string {
 	if g == nil {
 		return ""
 	}
-	for _, branch := range g.LastBuiltRevision.Branch {
-		if branch.Name != "" {
-			return branch.Name
+	for _, repo := range g.Repositories {
+		if branch := repo.Branch(); branch != "" {
+			return branch
 		}
 	}
 	return ""
 }
 
+// CommitIDs returns the revisions of all repositories
+func (g *GitStatus) CommitIDs() []string {
+	if g == nil {
+		return nil
+	}
+	commitIDs := make([]string, len(g.Repositories))
+	for i := range g.Repositories {
+		commitIDs[i] = g.Repositories[i].CommitID()
+	}
+	return commitIDs
+}
+
+// Branches returns the branches of all repositories
+func (g *GitStatus) Branches() []string {
+	if g == nil {
+		return nil
+	}
+	branches := make([]string, len(g.Repositories))
+	for i := range g.Repositories {
+		branches[i] = g.Repositories[i].Branch()
+	}
+	return branches
+}
+
+// HasCommit tells if any of the repositories was built at a revision
+// starting with prefix
+func (g *GitStatus) HasCommit(prefix string) bool {
+	for _, commitID := range g.CommitIDs() {
+		if commitID != "" && strings.HasPrefix(commitID, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 type Count int64
 
 func (c *Count) String() string {
@@ -147,15 +386,33 @@ func (s *TestReport) Prune() {
 }
 
 type Build struct {
-	Number int
+	Number  int
+	QueueID int
 }
 
 type JobBuilds struct {
-	Builds *[]Build
+	AllBuilds []Build
+}
+
+type JobHistory struct {
+	AllBuilds []struct {
+		Number int
+		JobStatus
+	}
 }
 
 type Job struct {
 	Name string
+	Jobs *[]Job // non-nil for folders
+}
+
+type QueueItem struct {
+	Cancelled  bool
+	Why        string
+	Executable *struct {
+		Number int
+		URL    string
+	}
 }
 
 type Jobs struct {
@@ -169,6 +426,8 @@ func (j *JobStatus) String() string {
 		j.TestReport.SkipCount, j.TestReport.FailCount)
 }
 
+// IsFailed tells whether a finished build did not succeed, builds not known
+// offline are not considered failed
 func (j *JobStatus) IsFailed() bool {
-	return j.Result != "SUCCESS" && !j.Building
+	return j.Result != "SUCCESS" && j.Result != "UNKNOWN" && !j.Building
 }
@@ -0,0 +1,25 @@
+package jenkins
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeJobStatus(t *testing.T) {
+	data := `{"building":false,"result":"SUCCESS","actions":[{},` +
+		`{"lastBuiltRevision":{"SHA1":"abc123",` +
+		`"branch":[{"SHA1":"abc123","name":"origin/master"}]},` +
+		`"remoteUrls":["https://github.com/ohmu/tjob.git"],"scmName":"tjob"},` +
+		`{"lastBuiltRevision":{"SHA1":"def456"},` +
+		`"remoteUrls":["https://github.com/ohmu/other.git"]}]}`
+	var status JobStatus
+	if err := json.Unmarshal([]byte(data), &status); err != nil {
+		t.Fatal(err)
+	}
+	status.Prune()
+	if status.Result != "SUCCESS" || status.Branch() != "origin/master" ||
+		!reflect.DeepEqual(status.CommitIDs(), []string{"abc123", "def456"}) {
+		t.Errorf("unexpected status: %+v", status)
+	}
+}
@@ -8,9 +8,10 @@ Licensed under the Apache License, Version 2.0 (see LICENSE)
 */
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/ohmu/tjob/config"
-	"github.com/ohmu/tjob/jenkins"
 	"github.com/ohmu/tjob/pipeline"
 	"time"
 )
@@ -25,12 +26,37 @@ func init() {
 		&listJobsCmd{})
 	globalParser().AddCommand("remove", "Remove jobs", "Remove jobs",
 		&removeJobsCmd{})
+	globalParser().AddCommand("resolve", "Resolve queued builds",
+		"Look up the build numbers of builds that were recorded while still waiting in the Jenkins queue",
+		&resolveJobsCmd{})
+	globalParser().AddCommand("gc", "Remove deleted builds",
+		"Remove tracked builds that no longer exist on Jenkins",
+		&gcJobsCmd{})
+	globalParser().AddCommand("tail", "Follow console output",
+		"Follow the console output of the selected running builds until they finish, --finished also prints the output of finished builds",
+		&tailJobsCmd{})
+	globalParser().AddCommand("terminate", "Abort running builds",
+		"Abort running builds and cancel queued builds",
+		&terminateJobsCmd{})
+	globalParser().AddCommand("graph", "Show build dependencies",
+		"Show the upstream and downstream builds of the selected builds as a tree, with --promotions also their promotion builds",
+		&graphJobsCmd{})
 }
 
-func handleErrors(errors <-chan error) error {
+func handleErrors(errCh <-chan error) error {
 	count := 0
-	for err := range errors {
+	interrupted := false
+	for err := range errCh {
+		if errors.Is(err, context.Canceled) {
+			// reported once, not for every aborted request
+			interrupted = true
+			continue
+		}
 		fmt.Println("error:", err)
+		count++
+	}
+	if interrupted {
+		return fmt.Errorf("interrupted")
 	}
 	if count > 0 {
 		return fmt.Errorf("there were %d errors", count)
@@ -45,12 +71,32 @@ type displayOptions struct {
 	ShowBuildURL      bool          `short:"l" long:"url" description:"Show build URL link"`
 	ShowBuilder       bool          `long:"builder" description:"Show builder"`
 	ShowTags          bool          `long:"tags" description:"Show tags"`
+	ShowOptions       []string      `long:"options" description:"Show build option/parameter KEY as a column"`
 	ShowUser          bool          `short:"u" long:"username" description:"Show username"`
 	ShowCommitID      bool          `short:"c" long:"commit-id" description:"Show version-control commit-id"`
 	ShowBranch        bool          `short:"B" long:"branch" description:"Show version-control branch"`
+	ShowAuthors       bool          `long:"authors" description:"Show authors of the commits in the build"`
+	ShowChanges       bool          `long:"changes" description:"Show commits in the build"`
+	ShowStages        bool          `long:"stages" description:"Show Pipeline stages of the build"`
+	ShowFailedStage   bool          `long:"failed-stage" description:"Show the first failed Pipeline stage"`
 	NoSorting         bool          `long:"no-sort" description:"CSV format, no output sorting, saves memory in large queries"`
 	FailedTestSummary bool          `long:"failed-summary" description:"Show a summary of failed test counts"`
 	SinceDuration     time.Duration `long:"since" description:"Show only builds started since X duration ago"` // TODO: better desc
+	templated         bool          // rendered with a template, which may use anything
+}
+
+// optionKeys returns the build option keys to show, "-options a,b" works
+// like "--options a --options b"
+func (d *displayOptions) optionKeys() []string {
+	return expandTags(d.ShowOptions)
+}
+
+// needsDetails tells if anything missing from the build summaries of
+// the remote build history is shown
+func (d *displayOptions) needsDetails() bool {
+	return d.ShowTestDetails || d.ShowTestTraceback || d.ShowTestOutput ||
+		d.FailedTestSummary || d.ShowStages || d.ShowFailedStage ||
+		d.templated
 }
 
 type remoteJobQuery struct {
@@ -63,10 +109,12 @@ type remoteJobQuery struct {
 
 func (node *remoteJobQuery) Run() error {
 	defer close(node.Output)
-	for runnerName, runner := range node.conf.Runners {
-		jenk := jenkins.MakeJenkins(runnerName, runner.URL,
-			runner.Insecure, nil) // JobCache not needed here
-		jobs, err := jenk.QueryJobs()
+	for runnerName := range node.conf.Runners {
+		jenk, err := getJenkins(node.conf, runnerName)
+		if err != nil {
+			return node.AbortWithError(err)
+		}
+		jobs, err := jenk.QueryJobs(node.Context())
 		if err != nil {
 			return node.AbortWithError(err)
 		}
@@ -84,7 +132,7 @@ func (node *remoteJobQuery) Run() error {
 			}
 
 			// TODO: concurrent requests, channels
-			builds, err := jenk.QueryJobBuilds(jobName)
+			builds, err := jenk.QueryJobHistory(node.Context(), jobName)
 			if err != nil {
 				return node.AbortWithError(err)
 			}
@@ -141,3 +189,21 @@ func (node *jobCopier) Run() error {
 	}
 	return nil
 }
+
+// selectedBuilds sets up the standard build selection pipeline, the status
+// query node tells how many queued builds were resolved
+func selectedBuilds(conf *config.Config, flags *filterFlags) ([]pipeline.Upstreamer, chan *JobStatus, *jobStatusQuery) {
+	jobber := configJobSender{Output: make(chan *config.Job, 10), conf: conf}
+	preFiltered := jobFilterer{Input: jobber.Output,
+		Output: make(chan *config.Job, 10), flags: flags}
+	collected := jobStatusQuery{Input: preFiltered.Output,
+		Output: make(chan *JobStatus, 10), conf: conf,
+		display: &displayOptions{NoSorting: true}}
+	sorter := jobStatusSorter{Input: collected.Output,
+		Output: make(chan *JobStatus, 10)}
+	postFiltered := resultFilterer{Input: sorter.Output,
+		Output: make(chan *JobStatus, 10), flags: flags,
+		display: &displayOptions{NoSorting: true}}
+	return []pipeline.Upstreamer{&jobber, &preFiltered, &collected,
+		&sorter, &postFiltered}, postFiltered.Output, &collected
+}
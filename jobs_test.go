@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/ohmu/tjob/pipeline"
+	"testing"
+	"time"
+)
+
+// blockedRequest fails with the context error once the pipeline is
+// cancelled, like an interrupted Jenkins request
+type blockedRequest struct {
+	pipeline.Node
+}
+
+func (node *blockedRequest) Run() error {
+	<-node.Context().Done()
+	return node.AbortWithError(fmt.Errorf("GET job: %w",
+		node.Context().Err()))
+}
+
+func TestHandleErrorsInterrupted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	nodes := []pipeline.Upstreamer{}
+	for i := 0; i < 5; i++ {
+		nodes = append(nodes, &blockedRequest{})
+	}
+	time.AfterFunc(10*time.Millisecond, cancel)
+	result := make(chan error)
+	go func() {
+		result <- handleErrors(pipeline.Wait(ctx, nodes...))
+	}()
+	select {
+	case err := <-result:
+		if err == nil || err.Error() != "interrupted" {
+			t.Errorf("got %v, expected interrupted", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pipeline did not finish after cancel")
+	}
+}
@@ -19,6 +19,23 @@ type JobStatus struct {
 	err    error
 }
 
+// AllOptions returns the build parameters reported by Jenkins, completed
+// with the options given when the build was started
+func (j *JobStatus) AllOptions() map[string]string {
+	options := make(map[string]string)
+	if j.Status != nil {
+		for key, value := range j.Status.XParameters {
+			options[key] = value
+		}
+	}
+	for key, value := range j.Options {
+		if _, exists := options[key]; !exists {
+			options[key] = value
+		}
+	}
+	return options
+}
+
 type jobStatusByBuildNumber []*JobStatus
 
 func (a jobStatusByBuildNumber) Len() int      { return len(a) }
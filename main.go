@@ -7,22 +7,46 @@ Licensed under the Apache License, Version 2.0 (see LICENSE)
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/jessevdk/go-flags"
 	"log"
 	"os"
+	"os/signal"
 	"path"
 	"runtime"
 	"runtime/pprof"
+	"syscall"
 )
 
 type topArgs struct {
-	ConfigFile string `short:"c" long:"config" description:"Config file path"`
+	ConfigFile        string  `short:"c" long:"config" description:"Config file path"`
+	MaxConcurrency    int     `long:"max-concurrency" description:"Maximum number of parallel HTTP requests per runner, overrides the runner settings"`
+	RequestsPerSecond float64 `long:"requests-per-second" description:"Maximum rate of HTTP requests per runner, overrides the runner settings"`
+	Offline           bool    `long:"offline" description:"Use only the local build cache, builds that are not cached show as UNKNOWN"`
 }
 
 var gParser *flags.Parser
 var globalFlags topArgs
 
+// globalContext is cancelled by the first SIGINT or SIGTERM, commands pass
+// it to their pipelines and finish gracefully
+var globalContext = context.Background()
+
+func handleSignals() {
+	ctx, cancel := context.WithCancel(context.Background())
+	globalContext = ctx
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		signal.Stop(signals) // a second signal terminates immediately
+		fmt.Fprintln(os.Stderr,
+			"interrupted, finishing up (interrupt again to quit)")
+		cancel()
+	}()
+}
+
 func globalParser() *flags.Parser {
 	if gParser == nil {
 		globalFlags.ConfigFile = path.Join(
@@ -62,6 +86,7 @@ func main() {
 				profileFile)
 		}()
 	}
+	handleSignals()
 	_, err := globalParser().ParseArgs(os.Args[1:])
 	if err != nil {
 		os.Exit(1)
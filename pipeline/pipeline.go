@@ -8,6 +8,7 @@ Licensed under the Apache License, Version 2.0 (see LICENSE)
 */
 
 import (
+	"context"
 	"fmt"
 	"log"
 )
@@ -29,7 +30,7 @@ func SetDebug(enabled bool) {
 type Upstreamer interface {
 	AbortWithError(error) error
 	Close()
-	Init(errors chan error, done chan struct{})
+	Init(ctx context.Context, errors chan error, done chan struct{})
 	Run() error
 	AbortSending()
 	ErrorChannel() chan error
@@ -38,6 +39,7 @@ type Upstreamer interface {
 }
 
 type Node struct {
+	ctx      context.Context
 	abortCh  chan struct{}
 	doneCh   chan struct{}
 	errorCh  chan error
@@ -60,6 +62,12 @@ func (n *Node) AbortChannel() chan struct{} {
 	return n.abortCh
 }
 
+// Context is cancelled when the whole pipeline is cancelled, pass it on to
+// blocking calls
+func (n *Node) Context() context.Context {
+	return n.ctx
+}
+
 func (n *Node) AbortWithError(err error) error {
 	if up := n.Upstreamer(); up != nil {
 		up.AbortSending()
@@ -69,10 +77,11 @@ func (n *Node) AbortWithError(err error) error {
 	return nil
 }
 
-func (n *Node) Init(errors chan error, done chan struct{}) {
+func (n *Node) Init(ctx context.Context, errors chan error, done chan struct{}) {
 	if n.AbortChannel() != nil {
 		panic("Node has already been initialized")
 	}
+	n.ctx = ctx
 	n.errorCh = errors
 	n.doneCh = done
 	// aborts are buffered, sender can finish its termination without waiting
@@ -109,7 +118,10 @@ func Start(node Upstreamer) {
 	}()
 }
 
-func Wait(upstream ...Upstreamer) <-chan error {
+// Wait starts the nodes and returns a channel of their errors, closed once
+// all the nodes have finished. Cancelling ctx aborts all the nodes and
+// reports the context error once.
+func Wait(ctx context.Context, upstream ...Upstreamer) <-chan error {
 	n := []Upstreamer{}
 	// filter out nil values
 	var prev Upstreamer
@@ -124,7 +136,7 @@ func Wait(upstream ...Upstreamer) <-chan error {
 			if prev != nil {
 				node.SetUpstream(prev)
 			}
-			node.Init(errors, done)
+			node.Init(ctx, errors, done)
 			Start(node)
 			n = append(n, node)
 			prev = node
@@ -141,8 +153,16 @@ func Wait(upstream ...Upstreamer) <-chan error {
 			close(errors)
 		}()
 		debug.Printf("Wait() started")
+		cancelled := ctx.Done()
 		for {
 			select {
+			case <-cancelled:
+				debug.Printf("Wait() cancelled: %s\n", ctx.Err())
+				cancelled = nil // report only once
+				for _, node := range n {
+					node.AbortSending()
+				}
+				waitOutput <- ctx.Err()
 			case node, ok := <-done:
 				if ok {
 					debug.Printf("Wait(): node %s finished\n",
@@ -1,8 +1,11 @@
 package pipeline
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"testing"
+	"time"
 )
 
 type MyNode struct {
@@ -10,6 +13,7 @@ type MyNode struct {
 	Input      chan int
 	Output     chan int
 	abortAt    int
+	count      int // values to generate, 0 for no limit
 	wasAborted bool
 }
 
@@ -25,26 +29,18 @@ type generator struct {
 }
 
 func (node *generator) Run() error {
-	abort := node.AbortChannel()
-	for i := 0; i < 10; i++ {
+	for i := 0; node.count == 0 || i < node.count; i++ {
+		if node.abortAt > 0 && i >= node.abortAt {
+			fmt.Println("generator aborting with error")
+			return node.AbortWithError(fmt.Errorf("value %d too big", i))
+		}
 		select {
-		case _, ok := <-abort:
-			if ok {
-				fmt.Println("generator got abort signal")
-				node.wasAborted = true
-				return nil
-			}
-			fmt.Println("generator abort ch closed")
-			abort = nil
-		default:
-			if node.abortAt > 0 && i >= node.abortAt {
-				fmt.Println("generator aborting with error")
-				return node.AbortWithError(
-					fmt.Errorf("value %d too big", i))
-			}
-			fmt.Println("generator sending", i)
-			node.Output <- i
-			//time.Sleep(100 * time.Millisecond)
+		case <-node.AbortChannel():
+			fmt.Println("generator got abort signal")
+			node.wasAborted = true
+			return nil
+		case node.Output <- i:
+			fmt.Println("generator sent", i)
 		}
 	}
 	fmt.Println("generator exiting normally")
@@ -56,37 +52,22 @@ type modifier struct {
 }
 
 func (node *modifier) Run() error {
-	input, errors := node.Input, node.UpstreamErrors()
 	count := 0
-	for {
-		select {
-		case value, ok := <-input:
-			if ok {
-				fmt.Println("modifier got value", value)
-				node.Output <- value * value
-				count++
-				if node.abortAt > 0 && count > node.abortAt {
-					return node.AbortWithError(
-						fmt.Errorf("modifier failed"))
-				}
-			} else {
-				fmt.Println("modifier input closed")
-				input = nil
-			}
-		case err, ok := <-errors:
-			if ok {
-				fmt.Println("modifier upstream error:", err)
-				node.ErrorChannel() <- err
-			} else {
-				fmt.Println("modifier error channel closed")
-				errors = nil
-			}
+	for value := range node.Input {
+		fmt.Println("modifier got value", value)
+		count++
+		if node.abortAt > 0 && count > node.abortAt {
+			return node.AbortWithError(fmt.Errorf("modifier failed"))
 		}
-		if input == nil && errors == nil {
-			fmt.Println("modifier exited normally")
+		select {
+		case <-node.AbortChannel():
+			node.wasAborted = true
 			return nil
+		case node.Output <- value * value:
 		}
 	}
+	fmt.Println("modifier exited normally")
+	return nil
 }
 
 type printer struct {
@@ -94,38 +75,28 @@ type printer struct {
 }
 
 func (node *printer) Run() error {
-	input, errors := node.Input, node.UpstreamErrors()
-	for {
-		select {
-		case value, ok := <-input:
-			if !ok {
-				fmt.Println("printer input closed")
-				input = nil
-			} else {
-				fmt.Println("printer got value:", value)
-			}
-		case err, ok := <-errors:
-			if !ok {
-				fmt.Println("printer error channel closed")
-				errors = nil
-
-			} else {
-				//time.Sleep(100 * time.Millisecond)
-				fmt.Println("printer upstream error:", err)
-				node.ErrorChannel() <- err
-			}
-		}
-		if input == nil && errors == nil {
-			fmt.Println("printer exited normally")
-			return nil
-		}
+	for value := range node.Input {
+		fmt.Println("printer got value:", value)
 	}
+	fmt.Println("printer exited normally")
+	return nil
+}
+
+// waiter blocks until the pipeline is cancelled and fails with the
+// context error, like an interrupted request
+type waiter struct {
+	Node
+}
+
+func (node *waiter) Run() error {
+	<-node.Context().Done()
+	return node.AbortWithError(fmt.Errorf("request: %w", node.Context().Err()))
 }
 
 func TestBasic(t *testing.T) {
 	SetDebug(true)
 
-	n1 := generator{}
+	n1 := generator{MyNode{count: 10}}
 	n1.Output = make(chan int, 10)
 
 	n2 := modifier{}
@@ -136,7 +107,7 @@ func TestBasic(t *testing.T) {
 	n3.Input = n2.Output
 
 	// extra nil's must be ignored
-	for err := range Wait(nil, &n1, nil, &n2, nil, &n3, nil) {
+	for err := range Wait(context.Background(), nil, &n1, nil, &n2, nil, &n3, nil) {
 		t.Errorf("did not expect error: %s", err)
 	}
 }
@@ -144,12 +115,12 @@ func TestBasic(t *testing.T) {
 func TestAbortFirst(t *testing.T) {
 	SetDebug(true)
 
-	n1 := generator{MyNode{Output: make(chan int, 2)}}
+	n1 := generator{MyNode{Output: make(chan int, 2), count: 10}}
 	n2 := modifier{MyNode: MyNode{Input: n1.Output, Output: make(chan int, 10),
 		abortAt: 5}} // modifier aborts in the middle of the input
 	n3 := printer{MyNode{Input: n2.Output}}
 
-	errorCh := Wait(&n1, &n2, &n3)
+	errorCh := Wait(context.Background(), &n1, &n2, &n3)
 	err := <-errorCh
 	if err == nil || err.Error() != "modifier failed" {
 		t.Errorf("first error with wrong msg: %s", err)
@@ -168,6 +139,42 @@ func TestAbortFirst(t *testing.T) {
 	}
 }
 
+func TestCancel(t *testing.T) {
+	SetDebug(true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n1 := generator{MyNode{Output: make(chan int)}} // never stops by itself
+	n2 := printer{MyNode{Input: n1.Output}}
+	w1, w2 := waiter{}, waiter{}
+
+	errorCh := Wait(ctx, &n1, &w1, &n2, &w2)
+	time.AfterFunc(10*time.Millisecond, cancel)
+	timeout := time.After(5 * time.Second)
+	cancelled := 0
+	for {
+		select {
+		case err, ok := <-errorCh:
+			if !ok {
+				// one from Wait itself and one from each waiter
+				if cancelled != 3 {
+					t.Errorf("got %d cancel errors, expected 3",
+						cancelled)
+				}
+				if !n1.wasAborted {
+					t.Errorf("generator was not aborted")
+				}
+				return
+			}
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("unexpected error: %s", err)
+			}
+			cancelled++
+		case <-timeout:
+			t.Fatal("Wait did not return after cancel")
+		}
+	}
+}
+
 /*
 func TestSketchApi(t *testing.T) {
 	SetDebug(true)
@@ -176,7 +183,7 @@ func TestSketchApi(t *testing.T) {
 	n2 := modifier{Input: n1.Output, Output: make(chan int, 10)}
 	n3 := printer{Input: n2.Input}
 
-	for err := range Wait(&n1, &n2, &n3) {
+	for err := range Wait(context.Background(), &n1, &n2, &n3) {
 		t.Errorf("did not expect error: %s", err)
 	}
 }
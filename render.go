@@ -15,8 +15,6 @@ import (
 	"github.com/ohmu/tjob/pipeline"
 	"os"
 	"sort"
-	"strings"
-	"sync"
 	"time"
 )
 
@@ -49,10 +47,16 @@ func (node *resultFilterer) Run() error {
 	defer close(node.Output)
 	var prev *JobStatus
 	for cur := range node.Input {
+		optionsMatched, err := filterByOptions(node.flags,
+			cur.AllOptions())
+		if err != nil {
+			return node.AbortWithError(err)
+		}
 		var sendVal *JobStatus
 		switch {
+		case !optionsMatched:
 		case node.flags.FilterCommit != "" &&
-			(cur.Status == nil || !strings.HasPrefix(cur.Status.CommitID(), node.flags.FilterCommit)):
+			(cur.Status == nil || !cur.Status.HasCommit(node.flags.FilterCommit)):
 		case node.display.SinceDuration != 0 &&
 			!filterByStartedSince(node.display, cur.Status):
 		case node.flags.OnlyAllFailed && (cur.Status == nil ||
@@ -91,55 +95,127 @@ func (node *resultFilterer) Run() error {
 
 type jobStatusQuery struct {
 	pipeline.Node
-	conf    *config.Config
-	display *displayOptions
-	Input   chan *config.Job
-	Output  chan *JobStatus
+	conf     *config.Config
+	display  *displayOptions
+	resolved int // number of queued jobs that got a build number
+	Input    chan *config.Job
+	Output   chan *JobStatus
+}
+
+// statusQueryResult is the outcome of querying a job, the jobs are shared
+// with the caller so only Run applies the resolved build numbers to them
+type statusQueryResult struct {
+	job         *config.Job
+	buildNumber string // resolved from the queue item of a queued job
+	status      *jenkins.JobStatus
+	err         error
+	interrupted bool
 }
 
+// query returns the status of a job, resolving the queue item of a queued
+// job first. The job is not modified.
+func (node *jobStatusQuery) query(jenk *jenkins.Jenkins, job *config.Job) *statusQueryResult {
+	result := &statusQueryResult{job: job, buildNumber: job.BuildNumber}
+	if job.IsQueued() && !jenk.Offline {
+		buildNumber, err := jenk.ResolveQueueItem(node.Context(),
+			job.JobName, job.QueueItem)
+		if err != nil {
+			result.err = fmt.Errorf("queue item %s: %s", job.QueueItem,
+				err)
+		}
+		result.buildNumber = buildNumber
+	}
+	switch {
+	case result.err != nil:
+	case result.buildNumber == "":
+		// placeholder, not finished and not failed (yet)
+		result.status = &jenkins.JobStatus{Building: true}
+	default:
+		result.status, result.err = jenk.QueryJobStatus(node.Context(),
+			job.JobName, result.buildNumber,
+			node.display.needsDetails())
+		if result.status == nil && result.err == nil {
+			result.err = fmt.Errorf("no status for build %s",
+				result.buildNumber)
+		}
+	}
+	result.interrupted = node.Context().Err() != nil
+	return result
+}
+
+// maxStatusQueries is the number of builds queried concurrently over all
+// the runners
+const maxStatusQueries = 100
+
 func (node *jobStatusQuery) Run() error {
 	defer close(node.Output)
-	limiter := make(chan struct{}, 10) // max concurrent ops
-	wgJenk := sync.WaitGroup{}
+	results := make(chan *statusQueryResult)
+	running := 0
 	i := 0
 	reportProgress := (terminal.IsTerminal(int(os.Stdout.Fd())) &&
 		!node.display.NoSorting)
-	for job := range node.Input {
-		jenk, err := getJenkins(node.conf, job.Runner)
-		if err != nil {
-			return node.AbortWithError(err)
+	input := node.Input
+	for input != nil || running > 0 {
+		accept := input
+		if running >= maxStatusQueries {
+			// only bounds the goroutines, the Jenkins clients
+			// limit the requests
+			accept = nil
 		}
+		select {
+		case <-node.AbortChannel():
+			return nil
+		case job, ok := <-accept:
+			if !ok {
+				input = nil
+				continue
+			}
+			jenk, err := getJenkins(node.conf, job.Runner)
+			if err != nil {
+				return node.AbortWithError(err)
+			}
 
-		// report query progress
-		if reportProgress {
-			locStr := fmt.Sprintf("%s %s %s", job.Runner,
-				job.JobName, job.BuildNumber)
-			if len(locStr) > 40 {
-				locStr = locStr[:40]
+			// report query progress
+			if reportProgress {
+				locStr := fmt.Sprintf("%s %s %s", job.Runner,
+					job.JobName, job.BuildNumber)
+				if len(locStr) > 40 {
+					locStr = locStr[:40]
+				}
+				fmt.Printf("%6d %-60s\r", i, locStr)
 			}
-			fmt.Printf("%6d %-60s\r", i, locStr)
-		}
 
-		wgJenk.Add(1)
-		limiter <- struct{}{} // don't want too many goroutines
-		go func(job *config.Job) {
-			defer wgJenk.Done()
-			status, err := jenk.QueryJobStatus(job.JobName,
-				job.BuildNumber, node.display.ShowTestDetails)
+			running++
+			go func(job *config.Job) {
+				result := node.query(jenk, job)
+				select {
+				case <-node.AbortChannel():
+				case results <- result:
+				}
+			}(job)
+			i++
+		case result := <-results:
+			running--
+			if result.interrupted {
+				continue // not a failure of the build
+			}
+			job := result.job
+			if job.IsQueued() && result.buildNumber != "" {
+				job.BuildNumber = result.buildNumber
+				job.QueueItem = ""
+				node.resolved++
+			}
 			select {
 			case <-node.AbortChannel():
-				return
-			case node.Output <- &JobStatus{job, status, err}:
+				return nil
+			case node.Output <- &JobStatus{job, result.status,
+				result.err}:
 			}
-			<-limiter
-		}(job)
-		i++
+		}
 	}
 	if reportProgress {
 		fmt.Printf("%6s %-60s\r", "", "") // clean up output
 	}
-	// wait for tasks to complete before closing output channel
-	wgJenk.Wait()
 	return nil
 }
 
@@ -22,6 +22,11 @@ type OutputWriter interface {
 	Flush() error
 }
 
+// optionField is the column name of a build option
+func optionField(key string) string {
+	return "OPT:" + key
+}
+
 type tabOutputRenderer struct {
 	pipeline.Node
 	display *displayOptions
@@ -32,24 +37,31 @@ func (node *tabOutputRenderer) Run() error {
 	// TODO: non-buffering implementation
 	var output OutputWriter
 	fields := []string{"RUNNER", "JOB", "BUILD", "BUILDER", "USER",
-		"BRANCH", "COMMIT-ID", "TAGS", "STATUS", "TIMESTAMP", "DURATION",
-		"PASS", "SKIP", "FAIL", "URL", "ERROR"}
+		"BRANCH", "COMMIT-ID", "TAGS"}
+	optionKeys := node.display.optionKeys()
+	for _, key := range optionKeys {
+		fields = append(fields, optionField(key))
+	}
+	fields = append(fields, "AUTHORS", "STATUS", "FAILED-STAGE",
+		"TIMESTAMP", "DURATION", "PASS", "SKIP", "FAIL", "URL", "ERROR")
 	if node.display.NoSorting {
 		output = csvout.New(fields)
 	} else {
 		output = tabout.New(fields, map[string]bool{
-			"BRANCH":    node.display.ShowBranch,
-			"BUILDER":   node.display.ShowBuilder,
-			"COMMIT-ID": node.display.ShowCommitID,
-			"TAGS":      node.display.ShowTags,
-			"URL":       node.display.ShowBuildURL,
-			"USER":      node.display.ShowUser,
+			"AUTHORS":      node.display.ShowAuthors,
+			"BRANCH":       node.display.ShowBranch,
+			"BUILDER":      node.display.ShowBuilder,
+			"COMMIT-ID":    node.display.ShowCommitID,
+			"FAILED-STAGE": node.display.ShowFailedStage,
+			"TAGS":         node.display.ShowTags,
+			"URL":          node.display.ShowBuildURL,
+			"USER":         node.display.ShowUser,
 		})
 	}
 	var results []*JobStatus
 	for res := range node.Input {
 		if node.display.ShowTestDetails || node.display.ShowTestOutput ||
-			node.display.ShowTestTraceback {
+			node.display.ShowTestTraceback || node.display.ShowChanges {
 			// only collect to a slice when it is required
 			results = append(results, res)
 		}
@@ -62,7 +74,10 @@ func (node *tabOutputRenderer) Run() error {
 			errStr = res.err.Error()
 		}
 		state := status.Result
-		if status.Building {
+		switch {
+		case res.IsQueued():
+			state = "QUEUED"
+		case status.Building:
 			state = "RUNNING"
 		}
 
@@ -73,31 +88,51 @@ func (node *tabOutputRenderer) Run() error {
 			fail = status.FailCount.String()
 		}
 		dur := status.Duration.String()
-		if status.Duration == 0 {
+		if res.IsQueued() || status.Timestamp == 0 {
+			dur = "" // not started, or not known offline
+		} else if status.Duration == 0 {
 			startTime := time.Unix(int64(
 				status.Timestamp)/1000, 0).Round(time.Second)
 			elapsed := time.Now().Round(time.Second).Sub(startTime)
 
 			dur = elapsed.String() + "+"
 		}
-		if err := output.Write(map[string]string{
+		values := map[string]string{
 			"RUNNER": res.Runner,
 			"JOB":    res.JobName, "BUILD": res.BuildNumber,
-			"BUILDER":   status.BuiltOn,
-			"USER":      status.XUserID,
-			"BRANCH":    status.GitStatus.Branch(),
-			"COMMIT-ID": status.GitStatus.CommitID(),
-			"TAGS":      strings.Join(res.Tags, ","),
-			"STATUS":    state,
-			"TIMESTAMP": status.Timestamp.String(),
-			"DURATION":  dur, "PASS": pass, "SKIP": skip,
+			"BUILDER":      status.BuiltOn,
+			"USER":         status.XUserID,
+			"BRANCH":       strings.Join(status.GitStatus.Branches(), ","),
+			"COMMIT-ID":    strings.Join(status.GitStatus.CommitIDs(), ","),
+			"TAGS":         strings.Join(res.Tags, ","),
+			"AUTHORS":      strings.Join(status.Authors(), ","),
+			"STATUS":       state,
+			"FAILED-STAGE": status.FailedStage(),
+			"TIMESTAMP":    status.Timestamp.String(),
+			"DURATION":     dur, "PASS": pass, "SKIP": skip,
 			"FAIL": fail, "URL": status.URL, "ERROR": errStr,
-		}); err != nil {
+		}
+		options := res.AllOptions()
+		for _, key := range optionKeys {
+			values[optionField(key)] = options[key]
+		}
+		if err := output.Write(values); err != nil {
 			return node.AbortWithError(err)
 		}
+		if node.display.ShowStages {
+			if err := writeStages(output, fields, status); err != nil {
+				return node.AbortWithError(err)
+			}
+		}
 	}
 	output.Flush()
 
+	if node.display.ShowChanges {
+		if err := node.renderChanges(results); err != nil {
+			return node.AbortWithError(err)
+		}
+	}
+
 	// print test results
 	skipStatuses := map[string]bool{
 		"PASSED": true, "FIXED": true, "SKIPPED": true}
@@ -145,3 +180,49 @@ func (node *tabOutputRenderer) Run() error {
 	output.Flush()
 	return nil
 }
+
+// writeStages writes a row for each Pipeline stage of a build below the
+// row of the build, the stage name is indented in the JOB column
+func writeStages(output OutputWriter, fields []string, status *jenkins.JobStatus) error {
+	for _, stage := range status.Stages {
+		values := make(map[string]string, len(fields))
+		for _, field := range fields {
+			values[field] = ""
+		}
+		values["JOB"] = "  " + stage.Name
+		values["STATUS"] = stage.Status
+		values["DURATION"] = stage.DurationMillis.String()
+		if err := output.Write(values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (node *tabOutputRenderer) renderChanges(results []*JobStatus) error {
+	output := tabout.New([]string{"RUNNER", "JOB", "BUILD", "COMMIT-ID",
+		"AUTHOR", "MESSAGE"}, nil)
+	first := true
+	for _, res := range results {
+		if res.Status == nil {
+			continue
+		}
+		for _, change := range res.Status.Changes() {
+			if first {
+				fmt.Println()
+				first = false
+			}
+			if err := output.Write(map[string]string{
+				"RUNNER":    res.Runner,
+				"JOB":       res.JobName,
+				"BUILD":     res.BuildNumber,
+				"COMMIT-ID": change.CommitID,
+				"AUTHOR":    change.Author.FullName,
+				"MESSAGE":   change.Title(),
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return output.Flush()
+}
@@ -0,0 +1,147 @@
+/*
+Package sshcmd - SSH Agent and Key Files
+
+Copyright (c) 2014 Ohmu Ltd.
+Licensed under the Apache License, Version 2.0 (see LICENSE)
+*/
+package sshcmd
+
+import (
+	"code.google.com/p/go.crypto/ssh"
+	"code.google.com/p/go.crypto/ssh/agent"
+	"code.google.com/p/go.crypto/ssh/terminal"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+)
+
+// defaultKeyFiles are tried in ~/.ssh when no key file is configured
+var defaultKeyFiles = []string{"id_rsa", "id_ecdsa", "id_ed25519"}
+
+var (
+	decryptMutex sync.Mutex
+	decrypted    = make(map[string]ssh.Signer) // asked only once per key
+)
+
+// keyRing offers the keys to the server in two rounds: first the agent
+// keys and the unencrypted key files, then the encrypted key files, whose
+// passphrases are only asked when the first round did not do
+type keyRing struct {
+	agentConn net.Conn
+	plain     []ssh.Signer
+	encrypted map[string][]byte // key file -> PEM
+	order     []string          // encrypted key files in config order
+	round     int
+}
+
+// loadKeys connects to the agent of SSH_AUTH_SOCK and reads the key files,
+// key files that do not exist are skipped
+func loadKeys(files []string) (*keyRing, error) {
+	keys := &keyRing{encrypted: make(map[string][]byte)}
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			keys.agentConn = conn
+			signers, err := agent.NewClient(conn).Signers()
+			if err == nil {
+				keys.plain = append(keys.plain, signers...)
+			}
+		} // no agent keys without a working agent
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			keys.Close()
+			return nil, fmt.Errorf("failed to load private key: %s", err)
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		var missing *ssh.PassphraseMissingError
+		switch {
+		case errors.As(err, &missing):
+			if _, seen := keys.encrypted[file]; !seen {
+				keys.encrypted[file] = data
+				keys.order = append(keys.order, file)
+			}
+		case err != nil:
+			keys.Close()
+			return nil, fmt.Errorf("failed to parse private key %s: %s",
+				file, err)
+		default:
+			keys.plain = append(keys.plain, signer)
+		}
+	}
+	if len(keys.plain) == 0 && len(keys.order) == 0 {
+		keys.Close()
+		return nil, errors.New("no SSH keys: no ssh-agent keys and no private key files")
+	}
+	return keys, nil
+}
+
+// authMethod offers the keys of both rounds
+func (keys *keyRing) authMethod() ssh.AuthMethod {
+	return ssh.RetryableAuthMethod(ssh.PublicKeysCallback(keys.signers), 2)
+}
+
+func (keys *keyRing) signers() ([]ssh.Signer, error) {
+	keys.round++
+	if keys.round == 1 && len(keys.plain) > 0 {
+		return keys.plain, nil
+	}
+	var signers []ssh.Signer
+	var firstErr error
+	for _, file := range keys.order {
+		signer, err := decryptKey(file, keys.encrypted[file])
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) == 0 {
+		return nil, firstErr
+	}
+	return signers, nil
+}
+
+// decryptKey asks the passphrase of an encrypted key on the terminal
+func decryptKey(file string, data []byte) (ssh.Signer, error) {
+	decryptMutex.Lock() // one prompt at a time
+	defer decryptMutex.Unlock()
+	if signer := decrypted[file]; signer != nil {
+		return signer, nil
+	}
+	tty := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(tty) {
+		return nil, fmt.Errorf(
+			"private key %s is encrypted, use ssh-agent or a terminal",
+			file)
+	}
+	fmt.Fprintf(os.Stderr, "Enter passphrase for key '%s': ", file)
+	passphrase, err := terminal.ReadPassword(tty)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKeyWithPassphrase(data, passphrase)
+	if errors.Is(err, x509.IncorrectPasswordError) {
+		return nil, fmt.Errorf("incorrect passphrase for key %s", file)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to parse private key %s: %s", file,
+			err)
+	}
+	decrypted[file] = signer
+	return signer, nil
+}
+
+func (keys *keyRing) Close() {
+	if keys.agentConn != nil {
+		keys.agentConn.Close()
+	}
+}
@@ -8,11 +8,12 @@ package sshcmd
 
 import (
 	"code.google.com/p/go.crypto/ssh"
+	"context"
 	"errors"
-	"io/ioutil"
-	"os"
+	"net"
 	"path"
 	"strconv"
+	"strings"
 )
 
 type SSHPort int
@@ -21,23 +22,14 @@ func (s *SSHPort) String() string {
 	return strconv.Itoa(int(*s))
 }
 
+// SSHNode is an SSH server, the settings that are not set are looked up in
+// ~/.ssh/config. The keys of ssh-agent are offered before the key files.
 type SSHNode struct {
-	Host string
-	Port SSHPort
-	User string
-	Key  string
-}
-
-func parseKey(file string) (ssh.Signer, error) {
-	privateBytes, err := ioutil.ReadFile(file)
-	if err != nil {
-		return nil, errors.New("failed to load private key")
-	}
-	private, err := ssh.ParsePrivateKey(privateBytes)
-	if err != nil {
-		return nil, errors.New("failed to parse private key")
-	}
-	return private, nil
+	Host        string
+	Port        SSHPort
+	DefaultPort SSHPort // used when neither Port nor ~/.ssh/config sets one, 22 if zero
+	User        string
+	Key         string // private key file, relative paths are relative to ~/.ssh
 }
 
 func command(session *ssh.Session, cmd string) (string, error) {
@@ -49,45 +41,103 @@ func close(session *ssh.Session) {
 	session.SendRequest("close", false, nil)
 }
 
-func (node *SSHNode) connect() (*ssh.Client, error) {
-	key := node.Key
-	if key == "" {
-		key = "id_rsa"
-	}
-	if !path.IsAbs(key) {
-		key = path.Join(os.Getenv("HOME"), ".ssh", key)
-	}
-	pkey, err := parseKey(key)
+// sshConfigFile is the OpenSSH client config consulted for the settings
+// the node does not have
+var sshConfigFile = path.Join(userSSHDir(), "config")
+
+// resolve returns the address, login user and key files for the node, its
+// own settings take precedence over ~/.ssh/config
+func (node *SSHNode) resolve() (addr, user string, keyFiles []string, err error) {
+	conf, err := readHostConfig(sshConfigFile, strings.ToLower(node.Host))
 	if err != nil {
-		return nil, err
+		return "", "", nil, err
 	}
-	user := node.User
+	host := node.Host
+	if conf.HostName != "" {
+		host = expandTokens(conf.HostName, node.Host, "")
+	}
+	user = node.User
 	if user == "" {
-		user = os.Getenv("LOGNAME")
+		user = conf.User
 	}
 	if user == "" {
-		return nil, errors.New("ssh login user not defined")
+		user = localUser()
 	}
-	config := &ssh.ClientConfig{
-		User: user,
-		Auth: []ssh.AuthMethod{ssh.PublicKeys(pkey)},
+	if user == "" {
+		return "", "", nil, errors.New("ssh login user not defined")
 	}
 	port := node.Port
+	if port == 0 {
+		port = conf.Port
+	}
+	if port == 0 {
+		port = node.DefaultPort
+	}
 	if port == 0 {
 		port = 22
 	}
-	client, err := ssh.Dial("tcp", node.Host+":"+port.String(), config)
+	if node.Key != "" {
+		keyFiles = append(keyFiles, node.Key)
+	}
+	for _, file := range conf.IdentityFiles {
+		keyFiles = append(keyFiles, expandTokens(file, host, user))
+	}
+	if len(keyFiles) == 0 {
+		keyFiles = append(keyFiles, defaultKeyFiles...)
+	}
+	for i, file := range keyFiles {
+		if !path.IsAbs(file) {
+			file = path.Join(userSSHDir(), file)
+		}
+		keyFiles[i] = file
+	}
+	return net.JoinHostPort(host, port.String()), user, keyFiles, nil
+}
+
+func (node *SSHNode) connect(ctx context.Context) (*ssh.Client, error) {
+	addr, user, keyFiles, err := node.resolve()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := loadKeys(keyFiles)
+	if err != nil {
+		return nil, err
+	}
+	defer keys.Close()
+	config := &ssh.ClientConfig{
+		User: user,
+		Auth: []ssh.AuthMethod{keys.authMethod()},
+	}
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
 	if err != nil {
 		return nil, errors.New("SSH connect failed: " + err.Error())
 	}
-	return client, nil
+	// the handshake does not know about ctx, closing the connection
+	// interrupts it
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, errors.New("SSH connect failed: " + err.Error())
+	}
+	return ssh.NewClient(c, chans, reqs), nil
 }
 
-func (node *SSHNode) Execute(cmd string) (output string, err error) {
-	client, err := node.connect()
+// Execute runs a command and returns its combined output, cancelling ctx
+// closes the connection
+func (node *SSHNode) Execute(ctx context.Context, cmd string) (output string, err error) {
+	client, err := node.connect(ctx)
 	if err != nil {
 		return "", err
 	}
+	defer client.Close()
+	stop := context.AfterFunc(ctx, func() { client.Close() })
+	defer stop()
 	session, err := client.NewSession()
 	if err != nil {
 		return "", errors.New(
@@ -96,5 +146,9 @@ func (node *SSHNode) Execute(cmd string) (output string, err error) {
 	defer close(session)
 	defer session.Close()
 
-	return command(session, cmd)
+	output, err = command(session, cmd)
+	if ctx.Err() != nil {
+		return output, ctx.Err()
+	}
+	return output, err
 }
@@ -0,0 +1,150 @@
+package sshcmd
+
+import (
+	"code.google.com/p/go.crypto/ssh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeFile(t *testing.T, file, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("LOGNAME", "local")
+	sshConfigFile = filepath.Join(home, ".ssh", "config")
+	defer func() { sshConfigFile = filepath.Join(userSSHDir(), "config") }()
+	writeFile(t, sshConfigFile, `# comment
+Host jenkins jenkins.example.com !other
+    HostName=jenkins.internal
+    User "ci user"
+    IdentityFile ~/.ssh/jenkins_%r
+
+Match exec "false"
+    User nobody
+
+Host *.example.com
+    Port 2222
+    User ignored
+    IdentityFile %d/.ssh/shared
+
+Host *
+Include config.d/*
+`)
+	writeFile(t, filepath.Join(home, ".ssh", "config.d", "extra"),
+		"Host jenkins*\n    IdentityFile extra\n")
+
+	for _, test := range []struct {
+		node     SSHNode
+		addr     string
+		user     string
+		keyFiles []string
+	}{
+		{SSHNode{Host: "jenkins.example.com"}, "jenkins.internal:2222",
+			"ci user", []string{home + "/.ssh/jenkins_ci user",
+				home + "/.ssh/shared", home + "/.ssh/extra"}},
+		{SSHNode{Host: "JENKINS", Port: 54410, User: "me", Key: "id"},
+			"jenkins.internal:54410", "me", []string{home + "/.ssh/id",
+				home + "/.ssh/jenkins_me", home + "/.ssh/extra"}},
+		{SSHNode{Host: "other"}, "other:22", "local",
+			[]string{home + "/.ssh/id_rsa", home + "/.ssh/id_ecdsa",
+				home + "/.ssh/id_ed25519"}},
+		{SSHNode{Host: "other", DefaultPort: 54410}, "other:54410",
+			"local", []string{home + "/.ssh/id_rsa",
+				home + "/.ssh/id_ecdsa", home + "/.ssh/id_ed25519"}},
+		{SSHNode{Host: "ci.example.com", DefaultPort: 54410},
+			"ci.example.com:2222", "ignored",
+			[]string{home + "/.ssh/shared"}},
+	} {
+		addr, user, keyFiles, err := test.node.resolve()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr != test.addr || user != test.user ||
+			!reflect.DeepEqual(keyFiles, test.keyFiles) {
+			t.Errorf("%+v: got %s %q %q, expected %s %q %q", test.node,
+				addr, user, keyFiles, test.addr, test.user,
+				test.keyFiles)
+		}
+	}
+}
+
+func TestMatchHost(t *testing.T) {
+	for _, test := range []struct {
+		host     string
+		patterns []string
+		matched  bool
+	}{
+		{"jenkins", []string{"*"}, true},
+		{"jenkins", []string{"jenk?ns"}, true},
+		{"jenkins", []string{"*.example.com"}, false},
+		{"ci.example.com", []string{"*.example.com", "!ci.*"}, false},
+		{"jenkins", []string{"!ci", "jen*"}, true},
+		{"jenkins", []string{"!ci"}, false},
+	} {
+		if matchHost(test.host, test.patterns) != test.matched {
+			t.Errorf("%s %q: expected %v", test.host, test.patterns,
+				test.matched)
+		}
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	dir := t.TempDir()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := ssh.MarshalPrivateKey(private, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := ssh.MarshalPrivateKeyWithPassphrase(private, "",
+		[]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainFile := filepath.Join(dir, "plain")
+	encryptedFile := filepath.Join(dir, "encrypted")
+	writeFile(t, plainFile, string(pem.EncodeToMemory(plain)))
+	writeFile(t, encryptedFile, string(pem.EncodeToMemory(encrypted)))
+
+	keys, err := loadKeys([]string{filepath.Join(dir, "missing"),
+		encryptedFile, plainFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keys.Close()
+	if len(keys.plain) != 1 || !reflect.DeepEqual(keys.order,
+		[]string{encryptedFile}) {
+		t.Errorf("got %d plain keys and encrypted keys %q", len(keys.plain),
+			keys.order)
+	}
+	if signers, err := keys.signers(); err != nil || len(signers) != 1 {
+		t.Errorf("first round: got %d keys, %v", len(signers), err)
+	}
+	// no terminal to ask the passphrase in tests
+	decrypted[encryptedFile] = keys.plain[0]
+	defer delete(decrypted, encryptedFile)
+	if signers, err := keys.signers(); err != nil || len(signers) != 1 {
+		t.Errorf("second round: got %d keys, %v", len(signers), err)
+	}
+
+	if _, err := loadKeys([]string{filepath.Join(dir, "missing")}); err == nil {
+		t.Error("expected an error without any keys")
+	}
+}
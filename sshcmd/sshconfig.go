@@ -0,0 +1,219 @@
+/*
+Package sshcmd - OpenSSH Client Config
+
+Copyright (c) 2014 Ohmu Ltd.
+Licensed under the Apache License, Version 2.0 (see LICENSE)
+*/
+package sshcmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxIncludeDepth stops Include loops
+const maxIncludeDepth = 16
+
+// hostConfig holds the ~/.ssh/config settings used for a host, the first
+// value found is used for each setting except IdentityFile
+type hostConfig struct {
+	HostName      string
+	User          string
+	Port          SSHPort
+	IdentityFiles []string
+}
+
+// readHostConfig returns the settings of the OpenSSH client config file
+// for host, a missing file has no settings. Match blocks are skipped.
+func readHostConfig(file, host string) (*hostConfig, error) {
+	conf := &hostConfig{}
+	if err := conf.read(file, host, true, 0); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func (c *hostConfig) read(file, host string, active bool, depth int) error {
+	if depth > maxIncludeDepth {
+		return fmt.Errorf("%s: too many nested includes", file)
+	}
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		keyword, args, err := splitConfigLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", file, lineNumber, err)
+		}
+		switch keyword {
+		case "":
+		case "host":
+			active = matchHost(host, args)
+		case "match":
+			active = false // criteria other than hosts are not known
+		case "include":
+			if !active {
+				continue
+			}
+			for _, pattern := range args {
+				if !path.IsAbs(pattern) {
+					pattern = path.Join(userSSHDir(), pattern)
+				}
+				files, err := filepath.Glob(pattern)
+				if err != nil {
+					return fmt.Errorf("%s:%d: %s", file, lineNumber, err)
+				}
+				for _, included := range files {
+					err := c.read(included, host, true, depth+1)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		default:
+			if active {
+				if err := c.set(keyword, args); err != nil {
+					return fmt.Errorf("%s:%d: %s", file, lineNumber,
+						err)
+				}
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+func (c *hostConfig) set(keyword string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%s without a value", keyword)
+	}
+	switch keyword {
+	case "hostname":
+		if c.HostName == "" {
+			c.HostName = args[0]
+		}
+	case "user":
+		if c.User == "" {
+			c.User = args[0]
+		}
+	case "port":
+		port, err := strconv.ParseUint(args[0], 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid port '%s'", args[0])
+		}
+		if c.Port == 0 {
+			c.Port = SSHPort(port)
+		}
+	case "identityfile":
+		c.IdentityFiles = append(c.IdentityFiles, args[0])
+	}
+	return nil
+}
+
+// splitConfigLine returns the lowercased keyword and the arguments of a
+// "Keyword arg..." or "Keyword=arg" line, arguments may be double quoted
+func splitConfigLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", nil, nil
+	}
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return strings.ToLower(line), nil, nil
+	}
+	keyword := strings.ToLower(line[:end])
+	rest := strings.TrimLeft(line[end:], " \t")
+	if strings.HasPrefix(rest, "=") {
+		rest = strings.TrimLeft(rest[1:], " \t")
+	}
+	var args []string
+	for rest != "" {
+		var arg string
+		if rest[0] == '"' {
+			closing := strings.IndexByte(rest[1:], '"')
+			if closing < 0 {
+				return "", nil, fmt.Errorf("unterminated quote")
+			}
+			arg, rest = rest[1:closing+1], rest[closing+2:]
+		} else if space := strings.IndexAny(rest, " \t"); space >= 0 {
+			arg, rest = rest[:space], rest[space:]
+		} else {
+			arg, rest = rest, ""
+		}
+		args = append(args, arg)
+		rest = strings.TrimLeft(rest, " \t")
+	}
+	return keyword, args, nil
+}
+
+// matchHost tells whether host matches a Host line, a pattern prefixed
+// with "!" excludes the hosts it matches
+func matchHost(host string, patterns []string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		if negated := strings.TrimPrefix(pattern, "!"); negated != pattern {
+			if matchPattern(strings.ToLower(negated), host) {
+				return false
+			}
+		} else if matchPattern(strings.ToLower(pattern), host) {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// matchPattern matches the "*" and "?" wildcards of OpenSSH patterns
+func matchPattern(pattern, name string) bool {
+	for pattern != "" {
+		switch pattern[0] {
+		case '*':
+			for i := len(name); i >= 0; i-- {
+				if matchPattern(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if name == "" {
+				return false
+			}
+		default:
+			if name == "" || pattern[0] != name[0] {
+				return false
+			}
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return name == ""
+}
+
+// expandTokens expands "~" and the %d (home), %h (remote host), %r (remote
+// user), %u (local user) and %% tokens of a config value
+func expandTokens(value, host, user string) string {
+	home := os.Getenv("HOME")
+	if value == "~" || strings.HasPrefix(value, "~/") {
+		value = home + value[1:]
+	}
+	return strings.NewReplacer("%%", "%", "%d", home, "%h", host,
+		"%r", user, "%u", localUser()).Replace(value)
+}
+
+func userSSHDir() string {
+	return path.Join(os.Getenv("HOME"), ".ssh")
+}
+
+func localUser() string {
+	if user := os.Getenv("LOGNAME"); user != "" {
+		return user
+	}
+	return os.Getenv("USER")
+}
@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"github.com/ohmu/tjob/config"
 	"github.com/ohmu/tjob/pipeline"
+	"time"
 )
 
 type startResultPrinter struct {
@@ -23,8 +24,13 @@ type startResultPrinter struct {
 func (node *startResultPrinter) Run() error {
 	defer close(node.Output)
 	for res := range node.Input {
-		fmt.Printf("started job: %s %s %s\n", res.Runner, res.JobName,
-			res.BuildNumber)
+		if res.IsQueued() {
+			fmt.Printf("queued job: %s %s (queue item %s)\n",
+				res.Runner, res.JobName, res.QueueItem)
+		} else {
+			fmt.Printf("started job: %s %s %s\n", res.Runner,
+				res.JobName, res.BuildNumber)
+		}
 		node.conf.Jobs = append(node.conf.Jobs, res)
 
 		// save after each successful launch, next one may fail
@@ -40,26 +46,34 @@ func (node *startResultPrinter) Run() error {
 
 type jobStarter struct {
 	pipeline.Node
-	conf   *config.Config
-	Input  chan *config.Job
-	Output chan *config.Job
+	conf      *config.Config
+	queueWait time.Duration
+	Input     chan *config.Job
+	Output    chan *config.Job
 }
 
 func (node *jobStarter) Run() error {
 	defer close(node.Output)
 	limiter := make(chan bool, 1) // launch one at a time
 	for job := range node.Input {
-		runner, exists := node.conf.Runners[job.Runner]
-		if !exists {
+		if _, exists := node.conf.Runners[job.Runner]; !exists {
 			return node.AbortWithError(fmt.Errorf("runner '%s' does not exists, use the 'runner add' command\n", job.Runner))
 		}
+		if node.Context().Err() != nil {
+			return nil // interrupted, start no more builds
+		}
 		limiter <- true
-		job, err := startJob(runner, job)
+		job, err := startJob(node.Context(), node.conf, job,
+			node.queueWait)
 		if err != nil {
 			return node.AbortWithError(err)
 		}
 		select {
 		case <-node.AbortChannel():
+			if node.Context().Err() != nil {
+				// interrupted, the build must still be saved
+				node.Output <- job
+			}
 			return nil
 		case node.Output <- job:
 		}